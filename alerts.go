@@ -0,0 +1,721 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Alert rule states, a rule is pending while its condition holds but not for long enough yet
+const (
+	alertOK      = "ok"
+	alertPending = "pending"
+	alertFiring  = "firing"
+)
+
+// alertResolved is the state sent in notifications when a firing rule goes back to ok
+const alertResolved = "resolved"
+
+// defaultAlertCheckInterval is how often stale topics and pending rules are checked by default
+const defaultAlertCheckInterval = 30 * time.Second
+
+// alertCheckInterval is how often stale topics and pending rules are checked
+var alertCheckInterval = defaultAlertCheckInterval
+
+// alertQueueSize is how many stored yoinks can wait for the alert rules of their topic before new ones are dropped
+const alertQueueSize = 4096
+
+// maxAlertBatch is the most queued yoinks that are evaluated together
+const maxAlertBatch = 256
+
+// alertsMu makes sure rules aren't evaluated by more than one goroutine at a time
+// Otherwise two yoinks published together could both see a rule as ok and notify twice
+var alertsMu sync.Mutex
+
+// alertCondition matches conditions like content.tempreading > 30
+var alertCondition = regexp.MustCompile(`^\s*content\.([^\s<>=!]+)\s*(>=|<=|==|!=|>|<)\s*(.+?)\s*$`)
+
+// AlertRule is a condition on the yoinks of a topic that notifies when it starts and stops holding
+// Threshold rules have a condition on the content of yoinks, stale rules fire when yoinks stop arriving
+type AlertRule struct {
+	ID         int64     `json:"id"`
+	Topic      string    `json:"topic"`
+	Name       string    `json:"name"`
+	Condition  string    `json:"condition,omitempty"`
+	For        string    `json:"for,omitempty"`
+	Stale      string    `json:"stale,omitempty"`
+	Webhook    string    `json:"webhook,omitempty"`
+	Secret     string    `json:"secret,omitempty"` // only returned when the rule is created
+	AlertTopic string    `json:"alert_topic,omitempty"`
+	State      string    `json:"state"`
+	StateSince time.Time `json:"state_since"`
+	LastSeen   time.Time `json:"last_seen"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	forDuration   time.Duration
+	staleDuration time.Duration
+	condition     *condition
+}
+
+// Alert is the notification sent when a rule starts firing or is resolved
+type Alert struct {
+	RuleID    int64       `json:"rule_id"`
+	Name      string      `json:"name"`
+	Topic     string      `json:"topic"`
+	Condition string      `json:"condition,omitempty"`
+	Stale     string      `json:"stale,omitempty"`
+	State     string      `json:"state"`
+	At        time.Time   `json:"at"`
+	YoinkID   int64       `json:"yoink_id,omitempty"`
+	Value     interface{} `json:"value,omitempty"`
+}
+
+// condition is a parsed threshold condition
+type condition struct {
+	path  []string
+	op    string
+	value interface{}
+}
+
+// parseCondition parses conditions like content.tempreading > 30 or content.door == "open"
+// Values are typed like query parameters, and quoted values are always strings
+func parseCondition(value string) (*condition, error) {
+	match := alertCondition.FindStringSubmatch(value)
+	if match == nil {
+		return nil, errors.New("condition must look like content.field > 30")
+	}
+
+	c := &condition{path: strings.Split(match[1], "."), op: match[2]}
+	for _, p := range c.path {
+		if p == "" {
+			return nil, errors.New("condition field " + match[1] + " has an empty path segment")
+		}
+	}
+	if strings.HasPrefix(match[3], `"`) {
+		s := ""
+		err := json.Unmarshal([]byte(match[3]), &s)
+		if err != nil {
+			return nil, errors.New("condition value " + match[3] + " is not a valid string")
+		}
+		c.value = s
+	} else {
+		c.value = inferType(match[3])
+	}
+
+	if c.op != "==" && c.op != "!=" {
+		if _, ok := toFloat(c.value); !ok {
+			return nil, errors.New("condition value must be a number to use " + c.op)
+		}
+	}
+	return c, nil
+}
+
+// lookup returns the value the condition is about, if the content has it
+func (c *condition) lookup(content map[string]interface{}) (interface{}, bool) {
+	var current interface{} = content
+	for _, p := range c.path {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = object[p]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// holds reports whether the condition holds for a value
+// Ordering comparisons never hold for values that aren't numbers
+func (c *condition) holds(value interface{}) bool {
+	a, aok := toFloat(value)
+	b, bok := toFloat(c.value)
+	switch c.op {
+	case "==":
+		if aok && bok {
+			return a == b
+		}
+		return value == c.value
+	case "!=":
+		if aok && bok {
+			return a != b
+		}
+		return value != c.value
+	}
+	if !aok || !bok {
+		return false
+	}
+	switch c.op {
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	}
+	return false
+}
+
+// toFloat converts the numbers found in content and conditions to a float
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// alertRuleColumns are the columns scanned by scanAlertRule
+const alertRuleColumns = `id, topic, name, condition, for_ms, stale_ms, webhook_url, secret, alert_topic, state, state_since, last_seen, created_at`
+
+// scanAlertRule scans a row of alertRuleColumns into a rule
+func scanAlertRule(rows *sql.Rows) (*AlertRule, error) {
+	rule := &AlertRule{}
+	forMs, staleMs := int64(0), int64(0)
+	err := rows.Scan(
+		&rule.ID,
+		&rule.Topic,
+		&rule.Name,
+		&rule.Condition,
+		&forMs,
+		&staleMs,
+		&rule.Webhook,
+		&rule.Secret,
+		&rule.AlertTopic,
+		&rule.State,
+		timeScanner{&rule.StateSince},
+		timeScanner{&rule.LastSeen},
+		timeScanner{&rule.CreatedAt},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rule.forDuration = time.Duration(forMs) * time.Millisecond
+	rule.staleDuration = time.Duration(staleMs) * time.Millisecond
+	if rule.forDuration > 0 {
+		rule.For = rule.forDuration.String()
+	}
+	if rule.staleDuration > 0 {
+		rule.Stale = rule.staleDuration.String()
+	}
+	if rule.Condition != "" {
+		rule.condition, err = parseCondition(rule.Condition)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rule, nil
+}
+
+// queryAlertRules returns the rules matching the conditions, secrets included
+func queryAlertRules(where string, args ...interface{}) ([]*AlertRule, error) {
+	rows, err := db.Query(`SELECT `+alertRuleColumns+` FROM alert_rules WHERE `+where+` ORDER BY id;`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []*AlertRule{}
+	for rows.Next() {
+		rule, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx so states can be stored inside a transaction or not
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// setAlertState stores the state of a rule and when it was entered
+func setAlertState(ex execer, rule *AlertRule, state string, since time.Time) error {
+	rule.State = state
+	rule.StateSince = since
+	_, err := ex.Exec(
+		`UPDATE alert_rules SET state = ?, state_since = ? WHERE id = ?;`,
+		state,
+		since.UTC().Format(timestampLayout),
+		rule.ID,
+	)
+	return err
+}
+
+// startAlertWorker evaluates alert rules in the background so publishing never waits for them
+// Until it's started rules are evaluated while publishing
+func (s *server) startAlertWorker() {
+	s.alerts = make(chan *Yoink, alertQueueSize)
+	go func() {
+		for y := range s.alerts {
+			// Yoinks that queued up while the previous ones were evaluated are evaluated together
+			yoinks := []*Yoink{y}
+			for len(yoinks) < maxAlertBatch && len(s.alerts) > 0 {
+				yoinks = append(yoinks, <-s.alerts)
+			}
+			s.evaluateAlerts(yoinks)
+		}
+	}()
+}
+
+// queueAlerts hands a yoink that has just been stored over to be evaluated against the rules of its topic
+// Like webhooks it never blocks publishing, if the queue is full the yoink is not evaluated
+func (s *server) queueAlerts(y *Yoink) {
+	if s.alerts == nil {
+		s.evaluateAlerts([]*Yoink{y})
+		return
+	}
+	select {
+	case s.alerts <- y:
+	default:
+		log.Println("alert queue is full, not evaluating yoink", y.ID)
+	}
+}
+
+// evaluateAlerts runs the rules of the topics of yoinks that have just been stored
+// Notifications are sent after evaluating so writing alerts to their topics never waits on the rules being updated
+func (s *server) evaluateAlerts(yoinks []*Yoink) {
+	alerts, err := evaluateAlertRules(yoinks)
+	if err != nil {
+		log.Println("evaluating alert rules failed:", err)
+	}
+	for _, a := range alerts {
+		s.notifyAlert(a)
+	}
+}
+
+// evaluateAlertRules updates the state of the rules of the topics of yoinks and returns the notifications to send
+// The rules of all the topics are looked up at once and their states are stored in one transaction
+func evaluateAlertRules(yoinks []*Yoink) ([]*alertNotification, error) {
+	alertsMu.Lock()
+	defer alertsMu.Unlock()
+
+	topics := map[string][]*AlertRule{}
+	placeholders := []string{}
+	args := []interface{}{}
+	for _, y := range yoinks {
+		if _, ok := topics[y.Topic]; !ok {
+			topics[y.Topic] = nil
+			placeholders = append(placeholders, "?")
+			args = append(args, y.Topic)
+		}
+	}
+	rules, err := queryAlertRules(`topic IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+	for _, rule := range rules {
+		topics[rule.Topic] = append(topics[rule.Topic], rule)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	notifications := []*alertNotification{}
+	for _, y := range yoinks {
+		for _, rule := range topics[y.Topic] {
+			n, err := evaluateAlertRule(tx, rule, y)
+			if err != nil {
+				return nil, err
+			}
+			if n != nil {
+				notifications = append(notifications, n)
+			}
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
+
+// evaluateAlertRule updates the state of a rule for a yoink of its topic and returns the notification to send, if any
+func evaluateAlertRule(tx *sql.Tx, rule *AlertRule, y *Yoink) (*alertNotification, error) {
+	// Stale rules only care that something arrived
+	if rule.condition == nil {
+		_, err := tx.Exec(`UPDATE alert_rules SET last_seen = ? WHERE id = ?;`, y.ReceivedAt.UTC().Format(timestampLayout), rule.ID)
+		if err != nil || rule.State != alertFiring {
+			return nil, err
+		}
+		err = setAlertState(tx, rule, alertOK, y.ReceivedAt)
+		if err != nil {
+			return nil, err
+		}
+		return newAlertNotification(rule, alertResolved, y, nil), nil
+	}
+
+	value, ok := rule.condition.lookup(y.Content)
+	if !ok {
+		return nil, nil
+	}
+	holds := rule.condition.holds(value)
+	switch {
+	case holds && rule.State == alertOK && rule.forDuration > 0:
+		return nil, setAlertState(tx, rule, alertPending, y.Timestamp)
+	case holds && (rule.State == alertOK || rule.State == alertPending && y.Timestamp.Sub(rule.StateSince) >= rule.forDuration):
+		// Rules without a duration fire right away, pending ones once the condition has held long enough
+		err := setAlertState(tx, rule, alertFiring, y.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		return newAlertNotification(rule, alertFiring, y, value), nil
+	case !holds && rule.State == alertPending:
+		return nil, setAlertState(tx, rule, alertOK, y.Timestamp)
+	case !holds && rule.State == alertFiring:
+		err := setAlertState(tx, rule, alertOK, y.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		return newAlertNotification(rule, alertResolved, y, value), nil
+	}
+	return nil, nil
+}
+
+// checkAlerts fires stale rules of topics that haven't received a yoink in time
+// and pending rules whose condition has held long enough without a new yoink coming in
+func (s *server) checkAlerts(now time.Time) {
+	alerts, err := checkAlertRules(now)
+	if err != nil {
+		log.Println("checking alert rules failed:", err)
+	}
+	for _, a := range alerts {
+		s.notifyAlert(a)
+	}
+}
+
+// checkAlertRules updates the state of rules that depend on time passing and returns the notifications to send
+func checkAlertRules(now time.Time) ([]*alertNotification, error) {
+	alertsMu.Lock()
+	defer alertsMu.Unlock()
+
+	rules, err := queryAlertRules(`state != ?`, alertFiring)
+	if err != nil {
+		return nil, err
+	}
+
+	notifications := []*alertNotification{}
+	for _, rule := range rules {
+		fire := false
+		if rule.condition == nil {
+			fire = now.Sub(rule.LastSeen) >= rule.staleDuration
+		} else {
+			fire = rule.State == alertPending && now.Sub(rule.StateSince) >= rule.forDuration
+		}
+		if !fire {
+			continue
+		}
+		err = setAlertState(db, rule, alertFiring, now)
+		if err != nil {
+			return notifications, err
+		}
+		notifications = append(notifications, newAlertNotification(rule, alertFiring, nil, nil))
+	}
+	return notifications, nil
+}
+
+// startAlertChecker periodically checks the rules that depend on time passing
+func (s *server) startAlertChecker() {
+	go func() {
+		ticker := time.NewTicker(alertCheckInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			s.checkAlerts(now.UTC())
+		}
+	}()
+}
+
+// alertNotification is an alert along with where it should be sent
+type alertNotification struct {
+	alert      *Alert
+	webhook    string
+	secret     string
+	alertTopic string
+}
+
+// newAlertNotification describes a change in the state of a rule, caused by a yoink or by time passing
+func newAlertNotification(rule *AlertRule, state string, y *Yoink, value interface{}) *alertNotification {
+	a := &Alert{
+		RuleID:    rule.ID,
+		Name:      rule.Name,
+		Topic:     rule.Topic,
+		Condition: rule.Condition,
+		Stale:     rule.Stale,
+		State:     state,
+		At:        rule.StateSince,
+		Value:     value,
+	}
+	if y != nil {
+		a.YoinkID = y.ID
+	}
+	return &alertNotification{alert: a, webhook: rule.Webhook, secret: rule.Secret, alertTopic: rule.AlertTopic}
+}
+
+// notifyAlert writes an alert to the alerts topic and sends it to the webhook of its rule
+func (s *server) notifyAlert(n *alertNotification) {
+	body, err := json.Marshal(n.alert)
+	if err != nil {
+		log.Println("encoding alert failed:", err)
+		return
+	}
+
+	if n.alertTopic != "" {
+		_, err = s.storeYoinks(context.Background(), pendingYoink{topic: n.alertTopic, content: body, fromAlert: true})
+		if err != nil {
+			log.Println("writing alert to topic", n.alertTopic, "failed:", err)
+		}
+	}
+
+	if n.webhook != "" {
+		go deliverAlert(n.webhook, n.secret, n.alert, body)
+	}
+}
+
+// deliverAlert sends an alert to a webhook, retrying with exponential backoff like yoink deliveries
+func deliverAlert(url, secret string, a *Alert, body []byte) {
+	deliveryID := "alert-" + strconv.FormatInt(a.RuleID, 10) + "-" + strconv.FormatInt(a.At.UnixNano(), 10)
+	backoff := webhookBaseBackoff
+	for attempt := 1; ; attempt++ {
+		_, err := postSigned(url, secret, "alert", deliveryID, body)
+		if err == nil {
+			return
+		}
+		if attempt >= webhookMaxAttempts {
+			log.Println("delivering alert of rule", a.RuleID, "failed:", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// alertRuleRequest is the body used to create an alert rule
+type alertRuleRequest struct {
+	Name       string `json:"name"`
+	Condition  string `json:"condition"`
+	For        string `json:"for"`
+	Stale      string `json:"stale"`
+	Webhook    string `json:"webhook"`
+	Secret     string `json:"secret"`
+	AlertTopic string `json:"alert_topic"`
+}
+
+// validate checks an alert rule request and returns the durations it holds
+func (req *alertRuleRequest) validate() (time.Duration, time.Duration, error) {
+	forDuration, staleDuration := time.Duration(0), time.Duration(0)
+	if (req.Condition == "") == (req.Stale == "") {
+		return 0, 0, errors.New("exactly one of condition and stale is required")
+	}
+	if req.Condition != "" {
+		_, err := parseCondition(req.Condition)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if req.For != "" {
+		if req.Condition == "" {
+			return 0, 0, errors.New("for can only be used with a condition")
+		}
+		d, err := time.ParseDuration(req.For)
+		if err != nil || d < 0 {
+			return 0, 0, errors.New("for is not a valid duration")
+		}
+		forDuration = d
+	}
+	if req.Stale != "" {
+		d, err := time.ParseDuration(req.Stale)
+		if err != nil || d <= 0 {
+			return 0, 0, errors.New("stale is not a valid duration")
+		}
+		staleDuration = d
+	}
+	if req.Webhook == "" && req.AlertTopic == "" {
+		return 0, 0, errors.New("at least one of webhook and alert_topic is required")
+	}
+	if req.Webhook != "" && !validWebhookURL(req.Webhook) {
+		return 0, 0, errors.New("webhook must be an absolute http or https URL that isn't a loopback, link-local or private address")
+	}
+	return forDuration, staleDuration, nil
+}
+
+// CreateAlertRule adds an alert rule to a topic
+func CreateAlertRule(w http.ResponseWriter, r *http.Request) {
+	topic := chi.URLParam(r, "topic")
+	if topic == "" {
+		e := NewHTTPError("topic is empty", http.StatusBadRequest, "Error validating topic name")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	body, err := readJSONBody(r)
+	if err != nil {
+		e := &HTTPError{}
+		if !errors.As(err, &e) {
+			e = &HTTPError{Cause: err.Error(), Detail: "Bad Request", Status: http.StatusBadRequest}
+		}
+		w.WriteHeader(e.Status)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	req := &alertRuleRequest{}
+	err = json.Unmarshal(body, req)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error decoding alert rule")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	forDuration, staleDuration, err := req.validate()
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error validating alert rule")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	// A rule writing to its own topic would see its alerts as readings, resolving stale rules and setting off the rest again
+	if req.AlertTopic == topic {
+		e := NewHTTPError("alert_topic must be a different topic than the one of the rule", http.StatusBadRequest, "Error validating alert rule")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	// Alerts are published like any other yoink so they can't be used to get around the key of the alerts topic,
+	// which the owner of that topic can send them to as well
+	if req.AlertTopic != "" {
+		creds := requestCredentials(r)
+		err = authorizeOwner(req.AlertTopic, creds)
+		if err != nil {
+			err = authorizeTopic(req.AlertTopic, creds)
+		}
+		if err != nil {
+			e := asHTTPError(err)
+			w.WriteHeader(e.Status)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+	}
+	if req.Webhook != "" && req.Secret == "" {
+		req.Secret, err = generateSecret()
+		if err != nil {
+			e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error generating webhook secret")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+	}
+
+	// Stale rules start counting from when they were created
+	now := time.Now().UTC().Format(timestampLayout)
+	rows, err := db.Query(
+		`INSERT INTO alert_rules (topic, name, condition, for_ms, stale_ms, webhook_url, secret, alert_topic, state, state_since, last_seen, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING `+alertRuleColumns+`;`,
+		topic,
+		req.Name,
+		req.Condition,
+		forDuration.Milliseconds(),
+		staleDuration.Milliseconds(),
+		req.Webhook,
+		req.Secret,
+		req.AlertTopic,
+		alertOK,
+		now,
+		now,
+		now,
+	)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error inserting alert rule to database")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	defer rows.Close()
+	rows.Next()
+	rule, err := scanAlertRule(rows)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error mapping query results to struct")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// GetAlertRules returns the alert rules of a topic along with their state, without their secrets
+func GetAlertRules(w http.ResponseWriter, r *http.Request) {
+	topic := chi.URLParam(r, "topic")
+	if topic == "" {
+		e := NewHTTPError("topic is empty", http.StatusBadRequest, "Error validating topic name")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	rules, err := queryAlertRules(`topic = ?`, topic)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error getting data from database")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	for _, rule := range rules {
+		rule.Secret = ""
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(rules)
+}
+
+// DeleteAlertRule removes an alert rule of a topic
+func DeleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	topic := chi.URLParam(r, "topic")
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error parsing alert rule id")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	res, err := db.Exec(`DELETE FROM alert_rules WHERE id = ? AND topic = ?;`, id, topic)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error deleting alert rule from database")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		e := NewHTTPError("alert rule "+strconv.FormatInt(id, 10)+" of topic "+topic+" does not exist", http.StatusNotFound, "Not Found")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createAlertRule adds an alert rule to a topic through the API with the key of the topic
+func createAlertRule(t *testing.T, topic, body, key string) (int, *AlertRule) {
+	req := httptest.NewRequest(http.MethodPost, "/topics/"+topic+"/alerts", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(topicKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		return w.Code, nil
+	}
+	rule := &AlertRule{}
+	err := json.NewDecoder(w.Body).Decode(rule)
+	if err != nil {
+		t.Fatalf("decoding response failed: %v", err)
+	}
+	return w.Code, rule
+}
+
+// alertRuleState returns the state of an alert rule as stored in the database
+func alertRuleState(t *testing.T, id int64) string {
+	rules, err := queryAlertRules(`id = ?`, id)
+	if err != nil || len(rules) != 1 {
+		t.Fatalf("getting alert rule %d failed: %v", id, err)
+	}
+	return rules[0].State
+}
+
+// TestParseCondition checks which conditions are accepted and when they hold
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		condition string
+		value     interface{}
+		holds     bool
+	}{
+		{"content.tempreading > 30", 30.5, true},
+		{"content.tempreading > 30", 30.0, false},
+		{"content.tempreading>=30", 30.0, true},
+		{"content.gps.lat < -1.5", -2.0, true},
+		{"content.count <= 7", int64(7), true},
+		{"content.door == \"open\"", "open", true},
+		{"content.door != \"open\"", "closed", true},
+		{"content.zooted == false", false, true},
+		{"content.tempreading == 30", 30.0, true},
+		{"content.tempreading > 30", "hot", false},
+	}
+
+	for _, tt := range tests {
+		c, err := parseCondition(tt.condition)
+		if err != nil {
+			t.Fatalf("parsing %q failed: %v", tt.condition, err)
+		}
+		if c.holds(tt.value) != tt.holds {
+			t.Errorf("%q with %#v: expected %v", tt.condition, tt.value, tt.holds)
+		}
+	}
+
+	for _, condition := range []string{"", "tempreading > 30", "content.tempreading", "content..a > 1", `content.door > "open"`, `content.door == "open`} {
+		_, err := parseCondition(condition)
+		if err == nil {
+			t.Errorf("expected error for %q", condition)
+		}
+	}
+}
+
+func TestThresholdAlert(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+	code, _ := registerTopic(t, "testtopic", `{"key":"hunter22","owner_key":"hunter22-owner"}`, "")
+	if code != http.StatusCreated {
+		t.Fatalf("expected topic to be registered got status %d", code)
+	}
+
+	code, rule := createAlertRule(t, "testtopic", `{"name":"hot","condition":"content.tempreading > 30","for":"5m","alert_topic":"alerts"}`, "hunter22-owner")
+	if code != http.StatusCreated || rule.State != alertOK || rule.For != "5m0s" {
+		t.Fatalf("expected alert rule to be created got status %d", code)
+	}
+
+	// The condition has to hold for 5 minutes before the rule fires
+	now := time.Now()
+	publishYoink("testtopic", "key=hunter22&tempreading=31&_timestamp="+strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10))
+	if state := alertRuleState(t, rule.ID); state != alertPending {
+		t.Fatalf("expected state %s got %s", alertPending, state)
+	}
+	publishYoink("testtopic", "key=hunter22&tempreading=33")
+	if state := alertRuleState(t, rule.ID); state != alertFiring {
+		t.Fatalf("expected state %s got %s", alertFiring, state)
+	}
+	publishYoink("testtopic", "key=hunter22&tempreading=34")
+	publishYoink("testtopic", "key=hunter22&tempreading=25")
+	if state := alertRuleState(t, rule.ID); state != alertOK {
+		t.Fatalf("expected state %s got %s", alertOK, state)
+	}
+
+	// Firing and resolving are written to the alerts topic once each
+	_, yoinks := getYoinks(t, "/yoinks/alerts?order=asc")
+	if len(yoinks) != 2 {
+		t.Fatalf("expected 2 alerts got %d", len(yoinks))
+	}
+	if yoinks[0].Content["state"] != alertFiring || yoinks[0].Content["value"] != 33.0 {
+		t.Fatalf("expected firing alert got %v", yoinks[0].Content)
+	}
+	if yoinks[1].Content["state"] != alertResolved || yoinks[1].Content["rule_id"] != float64(rule.ID) {
+		t.Fatalf("expected resolved alert got %v", yoinks[1].Content)
+	}
+
+	// Pending rules fire without a new yoink once enough time has passed
+	publishYoink("testtopic", "key=hunter22&tempreading=40")
+	testServer().checkAlerts(time.Now().Add(time.Minute))
+	if state := alertRuleState(t, rule.ID); state != alertPending {
+		t.Fatalf("expected state %s got %s", alertPending, state)
+	}
+	testServer().checkAlerts(time.Now().Add(6 * time.Minute))
+	if state := alertRuleState(t, rule.ID); state != alertFiring {
+		t.Fatalf("expected state %s got %s", alertFiring, state)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+func TestStaleAlert(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+	code, _ := registerTopic(t, "testtopic", `{"key":"hunter22","owner_key":"hunter22-owner"}`, "")
+	if code != http.StatusCreated {
+		t.Fatalf("expected topic to be registered got status %d", code)
+	}
+	// The receiver listens on a loopback address
+	allowPrivateWebhooks = true
+	defer func() { allowPrivateWebhooks = false }()
+
+	received := make(chan *Alert, 2)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(webhookSignatureHeader) != "sha256="+signWebhookBody("hunter2", body) {
+			t.Errorf("signature %q does not match body", r.Header.Get(webhookSignatureHeader))
+		}
+		a := &Alert{}
+		json.Unmarshal(body, a)
+		received <- a
+	}))
+	defer receiver.Close()
+
+	code, rule := createAlertRule(t, "testtopic", `{"name":"quiet","stale":"10m","webhook":"`+receiver.URL+`","secret":"hunter2"}`, "hunter22-owner")
+	if code != http.StatusCreated || rule.Secret != "hunter2" {
+		t.Fatalf("expected alert rule to be created got status %d", code)
+	}
+
+	testServer().checkAlerts(time.Now().Add(5 * time.Minute))
+	if state := alertRuleState(t, rule.ID); state != alertOK {
+		t.Fatalf("expected state %s got %s", alertOK, state)
+	}
+	testServer().checkAlerts(time.Now().Add(11 * time.Minute))
+	select {
+	case a := <-received:
+		if a.RuleID != rule.ID || a.State != alertFiring {
+			t.Fatalf("expected rule %d to fire got %+v", rule.ID, a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("alert was not delivered")
+	}
+
+	// A yoink arriving resolves it
+	publishYoink("testtopic", "key=hunter22&tempreading=25")
+	select {
+	case a := <-received:
+		if a.RuleID != rule.ID || a.State != alertResolved {
+			t.Fatalf("expected rule %d to be resolved got %+v", rule.ID, a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("alert was not delivered")
+	}
+
+	// Secrets are never listed
+	req := httptest.NewRequest(http.MethodGet, "/topics/testtopic/alerts?key=hunter22-owner", nil)
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	rules := []*AlertRule{}
+	err = json.NewDecoder(w.Body).Decode(&rules)
+	if err != nil {
+		t.Fatalf("decoding response failed: %v", err)
+	}
+	if len(rules) != 1 || rules[0].Secret != "" || rules[0].State != alertOK {
+		t.Fatalf("expected rule %d without secret got %+v", rule.ID, rules)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/topics/testtopic/alerts/"+strconv.FormatInt(rule.ID, 10)+"?key=hunter22-owner", nil)
+	w = httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d got %d", http.StatusNoContent, w.Code)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+func TestCreateAlertRuleErrors(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	// Only the owner of a registered topic can add rules to it
+	code, _ := createAlertRule(t, "testtopic", `{"stale":"1m","alert_topic":"alerts"}`, "")
+	if code != http.StatusConflict {
+		t.Fatalf("expected status %d got %d", http.StatusConflict, code)
+	}
+	code, _ = registerTopic(t, "testtopic", `{"key":"hunter22","owner_key":"hunter22-owner"}`, "")
+	if code != http.StatusCreated {
+		t.Fatalf("expected topic to be registered got status %d", code)
+	}
+	code, _ = createAlertRule(t, "testtopic", `{"stale":"1m","alert_topic":"alerts"}`, "")
+	if code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d got %d", http.StatusUnauthorized, code)
+	}
+
+	tests := []string{
+		`{"condition":"content.a > 1"}`,
+		`{"condition":"content.a > 1","stale":"1m","alert_topic":"alerts"}`,
+		`{"alert_topic":"alerts"}`,
+		`{"condition":"a > 1","alert_topic":"alerts"}`,
+		`{"condition":"content.a > 1","for":"soon","alert_topic":"alerts"}`,
+		`{"stale":"1m","for":"1m","alert_topic":"alerts"}`,
+		`{"stale":"0s","alert_topic":"alerts"}`,
+		`{"stale":"1m","webhook":"ftp://example.com"}`,
+		`{"stale":"1m","webhook":"http://169.254.169.254/latest/meta-data"}`,
+		`{"condition":"content.a != 1","alert_topic":"testtopic"}`,
+	}
+	for _, body := range tests {
+		code, _ := createAlertRule(t, "testtopic", body, "hunter22-owner")
+		if code != http.StatusBadRequest {
+			t.Errorf("expected status %d for %s got %d", http.StatusBadRequest, body, code)
+		}
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+// TestAlertsAreNotEvaluated checks that alerts written to a topic don't set off the rules of that topic
+func TestAlertsAreNotEvaluated(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	for _, topic := range []string{"testtopic", "alerts"} {
+		code, _ := registerTopic(t, topic, `{"key":"hunter22","owner_key":"hunter22-owner"}`, "")
+		if code != http.StatusCreated {
+			t.Fatalf("expected topic to be registered got status %d", code)
+		}
+	}
+
+	// Each rule fires on anything written to its topic and writes its alerts to the topic of the other one
+	code, rule := createAlertRule(t, "testtopic", `{"condition":"content.state != \"none\"","alert_topic":"alerts"}`, "hunter22-owner")
+	if code != http.StatusCreated {
+		t.Fatalf("expected alert rule to be created got status %d", code)
+	}
+	code, other := createAlertRule(t, "alerts", `{"condition":"content.state != \"none\"","alert_topic":"testtopic"}`, "hunter22-owner")
+	if code != http.StatusCreated {
+		t.Fatalf("expected alert rule to be created got status %d", code)
+	}
+
+	publishYoink("testtopic", "key=hunter22&state=open")
+	if state := alertRuleState(t, rule.ID); state != alertFiring {
+		t.Fatalf("expected state %s got %s", alertFiring, state)
+	}
+	if state := alertRuleState(t, other.ID); state != alertOK {
+		t.Fatalf("expected state %s got %s", alertOK, state)
+	}
+	if count := countYoinks(t, "alerts"); count != 1 {
+		t.Fatalf("expected 1 alert got %d", count)
+	}
+	if count := countYoinks(t, "testtopic"); count != 1 {
+		t.Fatalf("expected only the published yoink got %d", count)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+// TestAlertWorker checks that rules are evaluated in the background once the worker is started
+func TestAlertWorker(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+	code, _ := registerTopic(t, "testtopic", `{"key":"hunter22","owner_key":"hunter22-owner"}`, "")
+	if code != http.StatusCreated {
+		t.Fatalf("expected topic to be registered got status %d", code)
+	}
+	code, rule := createAlertRule(t, "testtopic", `{"name":"hot","condition":"content.tempreading > 30","alert_topic":"alerts"}`, "hunter22-owner")
+	if code != http.StatusCreated {
+		t.Fatalf("expected alert rule to be created got status %d", code)
+	}
+
+	s := testServer()
+	s.startAlertWorker()
+	for _, reading := range []string{"25", "31", "32"} {
+		req := httptest.NewRequest(http.MethodGet, "/publish/yoink/for/testtopic?key=hunter22&tempreading="+reading, nil)
+		w := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d got %d", http.StatusOK, w.Code)
+		}
+	}
+	// The alert is written to the alerts topic once, whenever the worker gets to it
+	count := 0
+	for i := 0; i < 100 && count == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		count = countYoinks(t, "alerts")
+	}
+	if count != 1 || alertRuleState(t, rule.ID) != alertFiring {
+		t.Fatalf("expected the rule to fire once got %d alerts", count)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// accessTokenParam is the query parameter that holds a JWT for clients that can't set headers, like browsers opening a WebSocket
+// Like the key of a topic it's never stored as part of the content
+const accessTokenParam = "access_token"
+
+// tokenVerifier checks the JWTs sent with requests, nil if JWT authentication isn't configured
+var tokenVerifier *jwtVerifier
+
+// claimsContextKey is the key of the verified claims of a request in its context
+type claimsContextKey struct{}
+
+// tokenClaims are the claims of a JWT accepted by datayoinker
+// publish and read hold the topics the token can be used for, * matches any characters of a topic name
+type tokenClaims struct {
+	Publish []string `json:"publish"`
+	Read    []string `json:"read"`
+	jwt.RegisteredClaims
+}
+
+// canPublish reports whether the token allows publishing to a topic
+func (c *tokenClaims) canPublish(topic string) bool {
+	return c != nil && matchTopic(c.Publish, topic)
+}
+
+// canRead reports whether the token allows reading a topic
+func (c *tokenClaims) canRead(topic string) bool {
+	return c != nil && matchTopic(c.Read, topic)
+}
+
+// matchTopic reports whether a topic matches any of the patterns
+func matchTopic(patterns []string, topic string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, topic); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// credentials are what a request can prove it's allowed to do with
+type credentials struct {
+	key    string       // the key of a registered topic
+	claims *tokenClaims // the claims of a verified JWT, nil without one
+}
+
+// requestCredentials returns the key and the verified claims sent with a request
+func requestCredentials(r *http.Request) credentials {
+	claims, _ := r.Context().Value(claimsContextKey{}).(*tokenClaims)
+	return credentials{key: requestKey(r), claims: claims}
+}
+
+// jwtKey is a key that JWTs can be verified with
+type jwtKey struct {
+	id  string // the kid of the key, empty if it has none
+	alg string // HS256, RS256 or EdDSA
+	key interface{}
+}
+
+// jwtVerifier verifies JWTs with a set of keys
+type jwtVerifier struct {
+	keys    []jwtKey
+	options []jwt.ParserOption
+}
+
+// newJWTVerifier creates a verifier for the keys, checking the issuer and audience of tokens if they are not empty
+func newJWTVerifier(keys []jwtKey, issuer, audience string) *jwtVerifier {
+	v := &jwtVerifier{
+		keys:    keys,
+		options: []jwt.ParserOption{jwt.WithValidMethods([]string{"HS256", "RS256", "EdDSA"}), jwt.WithExpirationRequired()},
+	}
+	if issuer != "" {
+		v.options = append(v.options, jwt.WithIssuer(issuer))
+	}
+	if audience != "" {
+		v.options = append(v.options, jwt.WithAudience(audience))
+	}
+	return v
+}
+
+// verify checks the signature and validity of a token and returns its claims
+func (v *jwtVerifier) verify(token string) (*tokenClaims, error) {
+	claims := &tokenClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, v.keyFor, v.options...)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// keyFor returns the keys a token could have been signed with, narrowed down by its kid if it has one
+func (v *jwtVerifier) keyFor(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	set := jwt.VerificationKeySet{}
+	for _, k := range v.keys {
+		if k.alg != token.Method.Alg() || (kid != "" && k.id != "" && k.id != kid) {
+			continue
+		}
+		set.Keys = append(set.Keys, k.key)
+	}
+	if len(set.Keys) == 0 {
+		return nil, errors.New("no key to verify a token signed with " + token.Method.Alg())
+	}
+	return set, nil
+}
+
+// authenticate is a middleware that verifies the JWT sent with a request and adds its claims to the context
+// Requests without a token go through untouched, requests with a token that doesn't verify are refused
+// Other Authorization schemes are ignored since they can belong to a reverse proxy in front of the server
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get(accessTokenParam)
+		scheme, value, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			token = strings.TrimSpace(value)
+		}
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if tokenVerifier == nil {
+			e := NewHTTPError("JWT authentication is not configured", http.StatusUnauthorized, "Unauthorized")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+		claims, err := tokenVerifier.verify(token)
+		if err != nil {
+			e := NewHTTPError(err.Error(), http.StatusUnauthorized, "Unauthorized")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey{}, claims)))
+	})
+}
+
+// SetupJWT configures the keys that JWTs are verified with
+// Any combination of a shared HS256 secret, a PEM file of RS256 or EdDSA public keys and a JWKS file can be used
+// Without any of them JWT authentication is disabled
+func SetupJWT() (*jwtVerifier, error) {
+	keys := []jwtKey{}
+	if secret := os.Getenv("DATAYOINKER_JWT_SECRET"); secret != "" {
+		keys = append(keys, jwtKey{alg: "HS256", key: []byte(secret)})
+	}
+	if file := os.Getenv("DATAYOINKER_JWT_PUBLIC_KEYS"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		pemKeys, err := parsePEMKeys(data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, pemKeys...)
+	}
+	if file := os.Getenv("DATAYOINKER_JWT_JWKS"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		jwksKeys, err := parseJWKS(data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, jwksKeys...)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return newJWTVerifier(keys, os.Getenv("DATAYOINKER_JWT_ISSUER"), os.Getenv("DATAYOINKER_JWT_AUDIENCE")), nil
+}
+
+// parsePEMKeys parses every RSA and Ed25519 public key in PEM data
+func parsePEMKeys(data []byte) ([]jwtKey, error) {
+	keys := []jwtKey{}
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			break
+		}
+		data = rest
+
+		var pub interface{}
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		default:
+			return nil, errors.New("unsupported PEM block " + block.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch k := pub.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, jwtKey{alg: "RS256", key: k})
+		case ed25519.PublicKey:
+			keys = append(keys, jwtKey{alg: "EdDSA", key: k})
+		default:
+			return nil, errors.New("only RSA and Ed25519 public keys are supported")
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public keys found")
+	}
+	return keys, nil
+}
+
+// jwk is a single key of a JSON Web Key Set as described in RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	K   string `json:"k"`
+}
+
+// parseJWKS parses the RSA, Ed25519 and symmetric keys of a JSON Web Key Set
+// Keys meant for encryption or other algorithms are skipped
+func parseJWKS(data []byte) ([]jwtKey, error) {
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []jwtKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key := jwtKey{id: k.Kid}
+		switch {
+		case k.Kty == "RSA" && (k.Alg == "" || k.Alg == "RS256"):
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, errors.New("key " + k.Kid + " has an invalid modulus")
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil || len(e) == 0 || len(e) > 4 {
+				return nil, errors.New("key " + k.Kid + " has an invalid exponent")
+			}
+			key.alg = "RS256"
+			key.key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "OKP" && k.Crv == "Ed25519" && (k.Alg == "" || k.Alg == "EdDSA"):
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, errors.New("key " + k.Kid + " has an invalid public key")
+			}
+			key.alg = "EdDSA"
+			key.key = ed25519.PublicKey(x)
+		case k.Kty == "oct" && (k.Alg == "" || k.Alg == "HS256"):
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil || len(secret) == 0 {
+				return nil, errors.New("key " + k.Kid + " has an invalid secret")
+			}
+			key.alg = "HS256"
+			key.key = secret
+		default:
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable keys found")
+	}
+	return keys, nil
+}
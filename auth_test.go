@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signToken creates a token scoped to the topics that expires in a minute
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, publish, read []string) string {
+	claims := tokenClaims{
+		Publish:          publish,
+		Read:             read,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+	}
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("signing token failed: %v", err)
+	}
+	return signed
+}
+
+// requestWithToken sends a request with a bearer token and returns the status code
+func requestWithToken(method, path, body, token string) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestSetupJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key failed: %v", err)
+	}
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating Ed25519 key failed: %v", err)
+	}
+
+	dir := t.TempDir()
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("encoding RSA key failed: %v", err)
+	}
+	pemFile := filepath.Join(dir, "keys.pem")
+	err = os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatalf("writing PEM file failed: %v", err)
+	}
+	jwksFile := filepath.Join(dir, "jwks.json")
+	jwks := `{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"device","x":"` + base64.RawURLEncoding.EncodeToString(edPublic) + `"},{"kty":"RSA","use":"enc","n":"AQAB","e":"AQAB"}]}`
+	err = os.WriteFile(jwksFile, []byte(jwks), 0o600)
+	if err != nil {
+		t.Fatalf("writing JWKS file failed: %v", err)
+	}
+
+	for _, name := range []string{"DATAYOINKER_JWT_SECRET", "DATAYOINKER_JWT_PUBLIC_KEYS", "DATAYOINKER_JWT_JWKS", "DATAYOINKER_JWT_ISSUER", "DATAYOINKER_JWT_AUDIENCE"} {
+		t.Setenv(name, "")
+	}
+	verifier, err := SetupJWT()
+	if err != nil || verifier != nil {
+		t.Fatalf("expected JWT authentication to be disabled got %v", err)
+	}
+
+	t.Setenv("DATAYOINKER_JWT_SECRET", "hunter2hunter2")
+	t.Setenv("DATAYOINKER_JWT_PUBLIC_KEYS", pemFile)
+	t.Setenv("DATAYOINKER_JWT_JWKS", jwksFile)
+	verifier, err = SetupJWT()
+	if err != nil {
+		t.Fatalf("setting up JWT authentication failed: %v", err)
+	}
+
+	valid := []string{
+		signToken(t, jwt.SigningMethodHS256, []byte("hunter2hunter2"), "", []string{"a"}, nil),
+		signToken(t, jwt.SigningMethodRS256, rsaKey, "", []string{"a"}, nil),
+		signToken(t, jwt.SigningMethodEdDSA, edPrivate, "device", []string{"a"}, nil),
+	}
+	for _, token := range valid {
+		claims, err := verifier.verify(token)
+		if err != nil || !claims.canPublish("a") || claims.canRead("a") {
+			t.Errorf("expected token to verify with publish scope got %v", err)
+		}
+	}
+
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	expired := jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims{RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))}})
+	expiredToken, _ := expired.SignedString([]byte("hunter2hunter2"))
+	noExpiry, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims{}).SignedString([]byte("hunter2hunter2"))
+	invalid := []string{
+		signToken(t, jwt.SigningMethodHS256, []byte("wrong"), "", []string{"a"}, nil),
+		signToken(t, jwt.SigningMethodHS384, []byte("hunter2hunter2"), "", []string{"a"}, nil),
+		signToken(t, jwt.SigningMethodEdDSA, otherKey, "device", []string{"a"}, nil),
+		signToken(t, jwt.SigningMethodEdDSA, edPrivate, "other", []string{"a"}, nil),
+		expiredToken,
+		noExpiry,
+		"not.a.token",
+	}
+	for _, token := range invalid {
+		_, err := verifier.verify(token)
+		if err == nil {
+			t.Errorf("expected token %s to be refused", token)
+		}
+	}
+
+	t.Setenv("DATAYOINKER_JWT_JWKS", pemFile)
+	_, err = SetupJWT()
+	if err == nil {
+		t.Fatalf("expected error for invalid JWKS file")
+	}
+}
+
+func TestJWTAuthorization(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+	secret := []byte("hunter2hunter2")
+	tokenVerifier = newJWTVerifier([]jwtKey{{alg: "HS256", key: secret}}, "", "")
+
+	code, _ := registerTopic(t, "sensors-kitchen", `{"key":"hunter22"}`, "")
+	if code != http.StatusCreated {
+		t.Fatalf("expected topic to be registered got status %d", code)
+	}
+	code, _ = registerTopic(t, "sensors-garage", `{"key":"hunter22","private":true}`, "")
+	if code != http.StatusCreated {
+		t.Fatalf("expected topic to be registered got status %d", code)
+	}
+
+	device := signToken(t, jwt.SigningMethodHS256, secret, "", []string{"sensors-*"}, nil)
+	dashboard := signToken(t, jwt.SigningMethodHS256, secret, "", nil, []string{"sensors-kitchen", "sensors-garage"})
+
+	// Tokens publish to the registered topics they are scoped to instead of using the key
+	if code := requestWithToken(http.MethodGet, "/publish/yoink/for/sensors-kitchen?tempreading=25", "", device); code != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, code)
+	}
+	if code := requestWithToken(http.MethodPost, "/yoink/sensors-kitchen", `{"tempreading":26}`, dashboard); code != http.StatusForbidden {
+		t.Fatalf("expected status %d got %d", http.StatusForbidden, code)
+	}
+	if code := requestWithToken(http.MethodGet, "/publish/yoink/for/sensors-kitchen?tempreading=25", "", "not.a.token"); code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d got %d", http.StatusUnauthorized, code)
+	}
+
+	// The token is not stored as part of the content
+	y, err := publishYoink("sensors-kitchen", "tempreading=27&access_token="+device)
+	if err != nil {
+		t.Fatalf("publish yoink failed: %v", err)
+	}
+	if _, ok := y.Content[accessTokenParam]; ok {
+		t.Fatalf("expected content without token got %v", y.Content)
+	}
+
+	// Tokens only read the private topics they are scoped to, on every read route
+	if code := requestWithToken(http.MethodGet, "/publish/yoink/for/sensors-garage?tempreading=12", "", device); code != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, code)
+	}
+	for _, path := range []string{"/yoink/sensors-garage", "/yoinks/sensors-garage", "/yoinks/sensors-garage/2", "/get/all/yoinks/from/sensors-garage", "/get/last/2/yoinks/from/sensors-garage"} {
+		if code := requestWithToken(http.MethodGet, path, "", dashboard); code != http.StatusOK {
+			t.Fatalf("expected status %d for %s got %d", http.StatusOK, path, code)
+		}
+		if code := requestWithToken(http.MethodGet, path, "", device); code != http.StatusForbidden {
+			t.Fatalf("expected status %d for %s got %d", http.StatusForbidden, path, code)
+		}
+	}
+	if code := requestWithToken(http.MethodGet, "/yoinks/sensors-garage/events", "", device); code != http.StatusForbidden {
+		t.Fatalf("expected status %d got %d", http.StatusForbidden, code)
+	}
+
+	// Tokens manage the topics they publish to, and private ones only if they can read them too
+	if code := requestWithToken(http.MethodPatch, "/topics/sensors-kitchen", `{"retention":"1h"}`, device); code != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, code)
+	}
+	if code := requestWithToken(http.MethodPatch, "/topics/sensors-garage", `{"retention":"1h"}`, device); code != http.StatusForbidden {
+		t.Fatalf("expected status %d got %d", http.StatusForbidden, code)
+	}
+	both := signToken(t, jwt.SigningMethodHS256, secret, "", []string{"sensors-garage"}, []string{"sensors-garage"})
+	if code := requestWithToken(http.MethodPatch, "/topics/sensors-garage", `{"retention":"1h"}`, both); code != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, code)
+	}
+
+	// A token never reads less than no token, so topics that aren't private can be read with any of them
+	for _, token := range []string{"", device, dashboard} {
+		if code := requestWithToken(http.MethodGet, "/yoinks/sensors-kitchen", "", token); code != http.StatusOK {
+			t.Fatalf("expected status %d got %d", http.StatusOK, code)
+		}
+	}
+
+	// Authorization headers of other schemes belong to proxies and are ignored
+	req := httptest.NewRequest(http.MethodGet, "/yoinks/sensors-kitchen", nil)
+	req.Header.Set("Authorization", "Basic dXNlcjpodW50ZXIy")
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, w.Code)
+	}
+
+	// Without a verifier tokens are refused instead of ignored
+	tokenVerifier = nil
+	if code := requestWithToken(http.MethodGet, "/yoinks/sensors-kitchen", "", dashboard); code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d got %d", http.StatusUnauthorized, code)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxBatchItems is the largest number of yoinks that can be published in one batch
+const maxBatchItems = 1000
+
+// BatchItem is a single yoink in a batch publish request
+type BatchItem struct {
+	Topic     string          `json:"topic"`     // optional if the topic is part of the URL
+	Timestamp json.RawMessage `json:"timestamp"` // optional RFC3339 string or Unix timestamp, defaults to the time of insertion
+	Content   json.RawMessage `json:"content"`
+}
+
+// PublishBatch adds many yoinks in a single transaction
+// The body is either a JSON array of items or newline-delimited JSON with one item per line
+// Either every yoink is stored and returned in order or nothing is stored at all
+func (s *server) PublishBatch(w http.ResponseWriter, r *http.Request) {
+	items, err := readBatchItems(r)
+	if err != nil {
+		e := &HTTPError{}
+		if !errors.As(err, &e) {
+			e = &HTTPError{Cause: err.Error(), Detail: "Bad Request", Status: http.StatusBadRequest}
+		}
+		w.WriteHeader(e.Status)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	if len(items) == 0 {
+		e := NewHTTPError("batch contains no items", http.StatusBadRequest, "Bad Request")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	if len(items) > maxBatchItems {
+		e := NewHTTPError("batch contains more than "+strconv.Itoa(maxBatchItems)+" items", http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	// Validate every item before touching the database so a bad item doesn't cost a rollback
+	defaultTopic := chi.URLParam(r, "topic")
+	validated := make([]pendingYoink, 0, len(items))
+	for i, item := range items {
+		v, err := validateBatchItem(item, defaultTopic)
+		if err != nil {
+			e := NewHTTPError("item "+strconv.Itoa(i)+": "+err.Error(), http.StatusBadRequest, "Error validating batch item")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+		validated = append(validated, v)
+	}
+
+	// Every registered topic in the batch has to accept the key or token of the request
+	creds := requestCredentials(r)
+	authorized := map[string]bool{}
+	for i, v := range validated {
+		if authorized[v.topic] {
+			continue
+		}
+		err = authorizeTopic(v.topic, creds)
+		if err != nil {
+			e := asHTTPError(err)
+			e.Cause = "item " + strconv.Itoa(i) + ": " + e.Cause
+			w.WriteHeader(e.Status)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+		authorized[v.topic] = true
+	}
+
+	// Store everything at once so the batch is stored atomically
+	// Listeners and webhooks only hear about the new yoinks once they are actually stored
+	yoinks, err := s.storeYoinks(r.Context(), validated...)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error inserting data to database")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	// If everything has gone well, return the JSON-encoded list of Yoink structs in the order they were sent
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(yoinks)
+}
+
+// validateBatchItem checks a batch item and fills in the topic from the URL if it has none
+func validateBatchItem(item BatchItem, defaultTopic string) (pendingYoink, error) {
+	v := pendingYoink{topic: item.Topic}
+	if v.topic == "" {
+		v.topic = defaultTopic
+	}
+	if v.topic == "" {
+		return v, errors.New("topic is empty")
+	}
+
+	if len(item.Timestamp) > 0 && string(item.Timestamp) != "null" {
+		t, err := parseTimestampJSON(item.Timestamp)
+		if err != nil {
+			return v, err
+		}
+		v.timestamp = t
+	}
+
+	content, err := compactJSONObject(item.Content)
+	if err != nil {
+		return v, err
+	}
+	v.content = content
+	return v, nil
+}
+
+// readBatchItems decodes the items of a batch request according to its Content-Type
+func readBatchItems(r *http.Request) ([]BatchItem, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, NewHTTPError("Content-Type must be application/json or application/x-ndjson", http.StatusUnsupportedMediaType, "Unsupported Media Type")
+	}
+
+	body, err := readBody(r, maxBatchBodySize)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []BatchItem{}
+	switch mediaType {
+	case "application/json":
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&items)
+		if err != nil {
+			return nil, NewHTTPError(err.Error(), http.StatusBadRequest, "Error decoding batch as a JSON array")
+		}
+		if decoder.More() {
+			return nil, NewHTTPError("unexpected data after JSON array", http.StatusBadRequest, "Error decoding batch as a JSON array")
+		}
+	case "application/x-ndjson", "application/ndjson":
+		reader := bufio.NewReader(bytes.NewReader(body))
+		for line := 1; ; line++ {
+			text, err := reader.ReadBytes('\n')
+			if len(bytes.TrimSpace(text)) > 0 {
+				item := BatchItem{}
+				decoder := json.NewDecoder(bytes.NewReader(text))
+				decoder.DisallowUnknownFields()
+				decodeErr := decoder.Decode(&item)
+				if decodeErr == nil && decoder.More() {
+					decodeErr = errors.New("more than one item on the same line")
+				}
+				if decodeErr != nil {
+					return nil, NewHTTPError("line "+strconv.Itoa(line)+": "+decodeErr.Error(), http.StatusBadRequest, "Error decoding batch as NDJSON")
+				}
+				items = append(items, item)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, NewHTTPError(err.Error(), http.StatusBadRequest, "Error reading request body")
+			}
+		}
+	default:
+		return nil, NewHTTPError("Content-Type must be application/json or application/x-ndjson", http.StatusUnsupportedMediaType, "Unsupported Media Type")
+	}
+	return items, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// publishBatch sends a batch publish request and returns the recorded response
+func publishBatch(path, contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	return w
+}
+
+// countYoinks returns the number of yoinks stored for a topic
+func countYoinks(t *testing.T, topic string) int {
+	count := 0
+	err := db.QueryRow(`SELECT COUNT(*) FROM yoinks WHERE `+yoinkTopicIs+`;`, topic).Scan(&count)
+	if err != nil {
+		t.Fatalf("counting yoinks failed: %v", err)
+	}
+	return count
+}
+
+func TestPublishBatchJSON(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	body := `[
+		{"content": {"reading": 1}},
+		{"topic": "othertopic", "content": {"reading": 2}},
+		{"timestamp": "2022-10-26T11:21:11Z", "content": {"gps": {"lat": 1.2}}}
+	]`
+	w := publishBatch("/yoinks/testtopic", "application/json", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d got %d with body %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	ys := []*Yoink{}
+	err = json.NewDecoder(w.Body).Decode(&ys)
+	if err != nil {
+		t.Fatalf("decoding response failed: %v", err)
+	}
+	if len(ys) != 3 {
+		t.Fatalf("expected 3 yoinks got %d", len(ys))
+	}
+	if ys[0].Topic != "testtopic" || ys[0].Content["reading"] != 1.0 {
+		t.Fatalf("wrong first yoink returned: %#v", ys[0])
+	}
+	if ys[1].Topic != "othertopic" || ys[1].Content["reading"] != 2.0 {
+		t.Fatalf("wrong second yoink returned: %#v", ys[1])
+	}
+	if !ys[2].Timestamp.Equal(time.Date(2022, 10, 26, 11, 21, 11, 0, time.UTC)) {
+		t.Fatalf("client timestamp not stored, got %s", ys[2].Timestamp)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+func TestPublishBatchNDJSON(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	body := `{"topic": "testtopic", "content": {"reading": 1}}
+
+{"topic": "testtopic", "content": {"reading": 2}}
+`
+	w := publishBatch("/yoinks", "application/x-ndjson", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d got %d with body %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if countYoinks(t, "testtopic") != 2 {
+		t.Fatalf("expected 2 stored yoinks")
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+func TestPublishBatchAtomic(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"missing topic", "/yoinks", "application/json", `[{"topic": "testtopic", "content": {"a": 1}}, {"content": {"a": 2}}]`, http.StatusBadRequest},
+		{"bad timestamp", "/yoinks/testtopic", "application/json", `[{"content": {"a": 1}}, {"timestamp": "yesterday", "content": {"a": 2}}]`, http.StatusBadRequest},
+		{"content not an object", "/yoinks/testtopic", "application/json", `[{"content": {"a": 1}}, {"content": [1, 2]}]`, http.StatusBadRequest},
+		{"unknown field", "/yoinks/testtopic", "application/json", `[{"content": {"a": 1}, "extra": true}]`, http.StatusBadRequest},
+		{"malformed line", "/yoinks/testtopic", "application/x-ndjson", "{\"content\": {\"a\": 1}}\n{\"content\": ", http.StatusBadRequest},
+		{"empty batch", "/yoinks/testtopic", "application/json", `[]`, http.StatusBadRequest},
+		{"wrong content type", "/yoinks/testtopic", "text/plain", `[{"content": {"a": 1}}]`, http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		w := publishBatch(tt.path, tt.contentType, tt.body)
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d got %d with body %s", tt.name, tt.status, w.Code, w.Body.String())
+		}
+	}
+
+	// None of the failed batches should have left anything behind
+	if count := countYoinks(t, "testtopic"); count != 0 {
+		t.Fatalf("expected no stored yoinks got %d", count)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// defaultBoltPath is where yoinks are kept when they are kept in bbolt and no path is configured
+const defaultBoltPath = "yoink.bolt"
+
+// boltIteratorChunk is how many yoinks an iterator reads in one transaction
+// Long read transactions stop bbolt from growing the file, so streams read a chunk at a time
+const boltIteratorChunk = 100
+
+// Every topic has a bucket in the topics bucket, holding its yoinks keyed by timestamp and id,
+// their keys keyed by id, and how many yoinks it has
+var (
+	boltTopicsBucket = []byte("topics")
+	boltYoinksBucket = []byte("yoinks")
+	boltIDsBucket    = []byte("ids")
+	boltCountKey     = []byte("count")
+)
+
+// boltStore keeps yoinks in a bbolt file
+// Keys sort by timestamp and then id, so reading a time range is a single scan of a topic
+type boltStore struct {
+	db *bolt.DB
+}
+
+// boltYoink is what's stored for a yoink, the rest of it is in its key and bucket
+type boltYoink struct {
+	ReceivedAt time.Time       `json:"received_at"`
+	Content    json.RawMessage `json:"content"`
+}
+
+// newBoltStore opens the bbolt file at path, creating it if it doesn't exist
+func newBoltStore(path string) (*boltStore, error) {
+	// Fail instead of waiting forever when another process has the file open
+	boltDB, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = boltDB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltTopicsBucket)
+		return err
+	})
+	if err != nil {
+		boltDB.Close()
+		return nil, err
+	}
+	return &boltStore{db: boltDB}, nil
+}
+
+// boltKey returns the key of a yoink
+// The sign bit of the timestamp is flipped so timestamps before 1970 sort before the ones after it
+func boltKey(timestamp time.Time, id int64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(timestamp.UnixMilli())^1<<63)
+	binary.BigEndian.PutUint64(key[8:], uint64(id))
+	return key
+}
+
+// parseBoltKey returns the timestamp and id of a yoink from its key
+func parseBoltKey(key []byte) (time.Time, int64) {
+	timestamp := time.UnixMilli(int64(binary.BigEndian.Uint64(key) ^ 1<<63)).UTC()
+	return timestamp, int64(binary.BigEndian.Uint64(key[8:]))
+}
+
+// boltID returns the key of a yoink in the ids bucket
+func boltID(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+// topicBuckets returns the buckets of a topic, nil if nothing was ever published to it
+func topicBuckets(tx *bolt.Tx, topic string) (topicBucket, yoinks, ids *bolt.Bucket) {
+	topicBucket = tx.Bucket(boltTopicsBucket).Bucket([]byte(topic))
+	if topicBucket == nil {
+		return nil, nil, nil
+	}
+	return topicBucket, topicBucket.Bucket(boltYoinksBucket), topicBucket.Bucket(boltIDsBucket)
+}
+
+// decodeBoltYoink turns a stored yoink back into a Yoink
+func decodeBoltYoink(topic string, key, value []byte) (*Yoink, error) {
+	stored := boltYoink{}
+	err := json.Unmarshal(value, &stored)
+	if err != nil {
+		return nil, err
+	}
+	y := &Yoink{Topic: topic, ReceivedAt: stored.ReceivedAt}
+	y.Timestamp, y.ID = parseBoltKey(key)
+	err = decodeContent(stored.Content, &y.Content)
+	if err != nil {
+		return nil, err
+	}
+	return y, nil
+}
+
+// addToCount changes how many yoinks a topic has
+func addToCount(topicBucket *bolt.Bucket, n int64) error {
+	count := int64(0)
+	if value := topicBucket.Get(boltCountKey); value != nil {
+		count = int64(binary.BigEndian.Uint64(value))
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(count+n))
+	return topicBucket.Put(boltCountKey, value)
+}
+
+// Publish stores the yoinks in a single transaction, ids come from the sequence of the topics bucket
+func (b *boltStore) Publish(_ context.Context, pending []pendingYoink) ([]*Yoink, error) {
+	receivedAt := time.Now().UTC().Truncate(time.Millisecond)
+	yoinks := make([]*Yoink, 0, len(pending))
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		topics := tx.Bucket(boltTopicsBucket)
+		for _, p := range pending {
+			topicBucket, err := topics.CreateBucketIfNotExists([]byte(p.topic))
+			if err != nil {
+				return err
+			}
+			yoinkBucket, err := topicBucket.CreateBucketIfNotExists(boltYoinksBucket)
+			if err != nil {
+				return err
+			}
+			idBucket, err := topicBucket.CreateBucketIfNotExists(boltIDsBucket)
+			if err != nil {
+				return err
+			}
+			seq, err := topics.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			// Timestamps are kept with the same precision as in the database so cursors work the same
+			y := &Yoink{ID: int64(seq), Topic: p.topic, Timestamp: p.timestamp.UTC().Truncate(time.Millisecond), ReceivedAt: receivedAt}
+			if p.timestamp.IsZero() {
+				y.Timestamp = receivedAt
+			}
+			err = decodeContent(p.content, &y.Content)
+			if err != nil {
+				return err
+			}
+			value, err := json.Marshal(boltYoink{ReceivedAt: receivedAt, Content: p.content})
+			if err != nil {
+				return err
+			}
+
+			key := boltKey(y.Timestamp, y.ID)
+			err = yoinkBucket.Put(key, value)
+			if err != nil {
+				return err
+			}
+			err = idBucket.Put(boltID(y.ID), key)
+			if err != nil {
+				return err
+			}
+			err = addToCount(topicBucket, 1)
+			if err != nil {
+				return err
+			}
+			yoinks = append(yoinks, y)
+		}
+		// The yoinks over the caps are deleted in the same transaction so they are never seen
+		for topic, maxYoinks := range topicCaps(pending) {
+			keep := int64(maxYoinks)
+			_, err := deleteOldestIn(tx, topic, -1, func(_ []byte, count int64) bool { return count > keep })
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return yoinks, nil
+}
+
+// Latest walks back from the newest yoink until one matches, stopping at the ones too old to match
+func (b *boltStore) Latest(_ context.Context, topic string, cond waitCondition) (*Yoink, error) {
+	var y *Yoink
+	err := b.db.View(func(tx *bolt.Tx) error {
+		_, yoinkBucket, _ := topicBuckets(tx, topic)
+		if yoinkBucket == nil {
+			return nil
+		}
+		c := yoinkBucket.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			timestamp, id := parseBoltKey(k)
+			if !cond.after.IsZero() && !timestamp.After(cond.after) {
+				return nil
+			}
+			if id > cond.afterID {
+				var err error
+				y, err = decodeBoltYoink(topic, k, v)
+				return err
+			}
+		}
+		return nil
+	})
+	return y, err
+}
+
+func (b *boltStore) LastID(_ context.Context, topic string) (int64, error) {
+	id := int64(0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		_, _, idBucket := topicBuckets(tx, topic)
+		if idBucket == nil {
+			return nil
+		}
+		if k, _ := idBucket.Cursor().Last(); k != nil {
+			id = int64(binary.BigEndian.Uint64(k))
+		}
+		return nil
+	})
+	return id, err
+}
+
+// LastN picks the newest yoinks in the range and only then puts them in the requested order
+func (b *boltStore) LastN(_ context.Context, topic string, n int, tr timeRange) (YoinkIterator, error) {
+	newest := tr
+	newest.ascending = false
+	yoinks, _, err := b.scan(topic, newest, nil, n)
+	if err != nil {
+		return nil, err
+	}
+	if tr.ascending {
+		reverseYoinks(yoinks)
+	}
+	return newYoinkSlice(yoinks), nil
+}
+
+func (b *boltStore) All(_ context.Context, topic string, tr timeRange, after *pageCursor) (YoinkIterator, error) {
+	it := &boltIterator{store: b, topic: topic, tr: tr}
+	if after != nil {
+		it.from = cursorKey(*after)
+	}
+	return it, nil
+}
+
+func (b *boltStore) Range(_ context.Context, topic string, tr timeRange, after *pageCursor, limit int) ([]*Yoink, error) {
+	var from []byte
+	if after != nil {
+		from = cursorKey(*after)
+	}
+	yoinks, _, err := b.scan(topic, tr, from, limit)
+	return yoinks, err
+}
+
+// cursorKey returns the key of the yoink a cursor points to
+func cursorKey(c pageCursor) []byte {
+	timestamp, _ := time.Parse(timestampLayout, c.Timestamp)
+	return boltKey(timestamp, c.ID)
+}
+
+// scan reads at most limit yoinks in the range in its order, starting after the key from or at the start of the range if it's nil
+// It also returns the key of the last yoink read so the scan can be continued
+func (b *boltStore) scan(topic string, tr timeRange, from []byte, limit int) ([]*Yoink, []byte, error) {
+	yoinks := []*Yoink{}
+	var last []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		_, yoinkBucket, _ := topicBuckets(tx, topic)
+		if yoinkBucket == nil {
+			return nil
+		}
+
+		// The range includes both bounds, since is the first possible key and until is the first one past it
+		var since, until []byte
+		if !tr.since.IsZero() {
+			since = boltKey(tr.since.Truncate(time.Millisecond), 0)
+		}
+		if !tr.until.IsZero() {
+			until = boltKey(tr.until.Truncate(time.Millisecond).Add(time.Millisecond), 0)
+		}
+
+		c := yoinkBucket.Cursor()
+		var k, v []byte
+		var next func() ([]byte, []byte)
+		inRange := func(k []byte) bool { return k != nil }
+		if tr.ascending {
+			next = c.Next
+			switch {
+			case from != nil && bytes.Compare(from, since) >= 0:
+				k, v = c.Seek(from)
+				if bytes.Equal(k, from) {
+					k, v = c.Next()
+				}
+			case since != nil:
+				k, v = c.Seek(since)
+			default:
+				k, v = c.First()
+			}
+			if until != nil {
+				inRange = func(k []byte) bool { return k != nil && bytes.Compare(k, until) < 0 }
+			}
+		} else {
+			next = c.Prev
+			// Start right before the first key past the range
+			end := until
+			if from != nil && (end == nil || bytes.Compare(from, end) < 0) {
+				end = from
+			}
+			if end == nil {
+				k, v = c.Last()
+			} else if k, _ = c.Seek(end); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+			if since != nil {
+				inRange = func(k []byte) bool { return k != nil && bytes.Compare(k, since) >= 0 }
+			}
+		}
+
+		for ; inRange(k) && len(yoinks) != limit; k, v = next() {
+			y, err := decodeBoltYoink(topic, k, v)
+			if err != nil {
+				return err
+			}
+			yoinks = append(yoinks, y)
+			last = append(last[:0], k...)
+		}
+		return nil
+	})
+	return yoinks, last, err
+}
+
+func (b *boltStore) After(_ context.Context, topic string, id int64) (YoinkIterator, error) {
+	yoinks := []*Yoink{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		_, yoinkBucket, idBucket := topicBuckets(tx, topic)
+		if idBucket == nil {
+			return nil
+		}
+		c := idBucket.Cursor()
+		for _, key := c.Seek(boltID(id + 1)); key != nil; _, key = c.Next() {
+			y, err := decodeBoltYoink(topic, key, yoinkBucket.Get(key))
+			if err != nil {
+				return err
+			}
+			yoinks = append(yoinks, y)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newYoinkSlice(yoinks), nil
+}
+
+func (b *boltStore) Topics(context.Context) ([]string, error) {
+	topics := []string{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTopicsBucket).ForEach(func(k, _ []byte) error {
+			topics = append(topics, string(k))
+			return nil
+		})
+	})
+	return topics, err
+}
+
+func (b *boltStore) DeleteTopic(_ context.Context, topic string) (int64, error) {
+	deleted := int64(0)
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		topicBucket, _, _ := topicBuckets(tx, topic)
+		if topicBucket == nil {
+			return nil
+		}
+		if value := topicBucket.Get(boltCountKey); value != nil {
+			deleted = int64(binary.BigEndian.Uint64(value))
+		}
+		return tx.Bucket(boltTopicsBucket).DeleteBucket([]byte(topic))
+	})
+	return deleted, err
+}
+
+// DeleteBefore deletes in batches of deleteBatchSize, each in its own transaction so publishing isn't blocked for long
+func (b *boltStore) DeleteBefore(_ context.Context, topic string, cutoff time.Time) (int64, error) {
+	end := boltKey(cutoff, 0)
+	return b.deleteOldest(topic, func(k []byte, _ int64) bool { return bytes.Compare(k, end) < 0 })
+}
+
+// Trim deletes in batches as well since lowering the cap of a large topic can delete a lot of yoinks
+func (b *boltStore) Trim(_ context.Context, topic string, keep int) (int64, error) {
+	return b.deleteOldest(topic, func(_ []byte, count int64) bool { return count > int64(keep) })
+}
+
+// deleteOldest deletes the oldest yoinks of a topic for as long as shouldDelete is true for them
+// shouldDelete gets the key of the yoink and how many yoinks the topic has before deleting it
+func (b *boltStore) deleteOldest(topic string, shouldDelete func(k []byte, count int64) bool) (int64, error) {
+	deleted := int64(0)
+	for {
+		n := int64(0)
+		err := b.db.Update(func(tx *bolt.Tx) error {
+			var err error
+			n, err = deleteOldestIn(tx, topic, deleteBatchSize, shouldDelete)
+			return err
+		})
+		deleted += n
+		if err != nil || n < deleteBatchSize {
+			return deleted, err
+		}
+		time.Sleep(deleteBatchPause)
+	}
+}
+
+// deleteOldestIn deletes at most limit of the oldest yoinks of a topic in a transaction for as long as shouldDelete is true for them
+// A negative limit deletes every yoink shouldDelete is true for
+func deleteOldestIn(tx *bolt.Tx, topic string, limit int, shouldDelete func(k []byte, count int64) bool) (int64, error) {
+	topicBucket, yoinkBucket, idBucket := topicBuckets(tx, topic)
+	if topicBucket == nil {
+		return 0, nil
+	}
+	count := int64(binary.BigEndian.Uint64(topicBucket.Get(boltCountKey)))
+
+	// Deleting while moving a cursor skips keys, so the keys are collected first
+	keys := [][]byte{}
+	c := yoinkBucket.Cursor()
+	for k, _ := c.First(); k != nil && len(keys) != limit && shouldDelete(k, count-int64(len(keys))); k, _ = c.Next() {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		_, id := parseBoltKey(k)
+		err := yoinkBucket.Delete(k)
+		if err != nil {
+			return 0, err
+		}
+		err = idBucket.Delete(boltID(id))
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := int64(len(keys))
+	return n, addToCount(topicBucket, -n)
+}
+
+// boltIterator reads the yoinks of a range a chunk at a time, each chunk in its own read transaction
+type boltIterator struct {
+	store  *boltStore
+	topic  string
+	tr     timeRange
+	from   []byte // key of the last yoink read, nil before reading any
+	yoinks []*Yoink
+	next   int
+	done   bool
+	err    error
+}
+
+func (it *boltIterator) Next() bool {
+	if it.next < len(it.yoinks) {
+		it.next++
+		return true
+	}
+	if it.done || it.err != nil {
+		return false
+	}
+	yoinks, last, err := it.store.scan(it.topic, it.tr, it.from, boltIteratorChunk)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.yoinks, it.next, it.from = yoinks, 0, last
+	it.done = len(yoinks) < boltIteratorChunk
+	if len(yoinks) == 0 {
+		return false
+	}
+	it.next++
+	return true
+}
+
+func (it *boltIterator) Yoink() (*Yoink, error) {
+	return it.yoinks[it.next-1], nil
+}
+
+func (it *boltIterator) Err() error {
+	return it.err
+}
+
+func (it *boltIterator) Close() error {
+	return nil
+}
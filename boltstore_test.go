@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBoltStore(t *testing.T) {
+	testPath := "/tmp/yoinker.bolt"
+	store, err := newBoltStore(testPath)
+	if err != nil {
+		t.Fatalf("opening bbolt failed: %v", err)
+	}
+
+	checkStore(t, store)
+
+	// Yoinks are still there after opening the file again
+	store.db.Close()
+	store, err = newBoltStore(testPath)
+	if err != nil {
+		t.Fatalf("opening bbolt again failed: %v", err)
+	}
+	topics, err := store.Topics(context.Background())
+	if err != nil || len(topics) != 2 {
+		t.Fatalf("expected 2 topics got %v", topics)
+	}
+
+	store.db.Close()
+	err = os.Remove(testPath)
+	if err != nil {
+		t.Errorf("cleaning up temporary test file failed: %v", err)
+	}
+}
+
+// TestBoltStoreStreamsInChunks checks that streams read past the first chunk without skipping or repeating yoinks
+func TestBoltStoreStreamsInChunks(t *testing.T) {
+	testPath := "/tmp/yoinker.bolt"
+	store, err := newBoltStore(testPath)
+	if err != nil {
+		t.Fatalf("opening bbolt failed: %v", err)
+	}
+	ctx := context.Background()
+
+	start := time.Date(2022, 10, 26, 11, 0, 0, 0, time.UTC)
+	pending := []pendingYoink{}
+	for i := 0; i < 2*boltIteratorChunk+1; i++ {
+		pending = append(pending, pendingYoink{topic: "testtopic", timestamp: start.Add(time.Duration(i) * time.Second), content: []byte(`{"i":` + strconv.Itoa(i) + `}`)})
+	}
+	_, err = store.Publish(ctx, pending)
+	if err != nil {
+		t.Fatalf("publishing failed: %v", err)
+	}
+
+	it, err := store.All(ctx, "testtopic", timeRange{ascending: true}, nil)
+	if err != nil {
+		t.Fatalf("reading all yoinks failed: %v", err)
+	}
+	yoinks, err := collectYoinks(it)
+	if err != nil || len(yoinks) != len(pending) {
+		t.Fatalf("expected %d yoinks got %d", len(pending), len(yoinks))
+	}
+	for i, y := range yoinks {
+		if y.Content["i"] != json.Number(strconv.Itoa(i)) {
+			t.Fatalf("expected yoink %d got %v", i, y.Content["i"])
+		}
+	}
+
+	// Keys sort by timestamp, including before 1970
+	if bytes.Compare(boltKey(time.Unix(-1, 0), 2), boltKey(time.Unix(0, 0), 1)) >= 0 {
+		t.Fatalf("expected yoinks before 1970 to sort first")
+	}
+
+	store.db.Close()
+	err = os.Remove(testPath)
+	if err != nil {
+		t.Errorf("cleaning up temporary test file failed: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// reservedParamPrefix marks query parameters that configure publishing instead of being stored
+const reservedParamPrefix = "_"
+
+// rawParam is the reserved query parameter that keeps every value as a string
+const rawParam = reservedParamPrefix + "raw"
+
+// reservedParams are the reserved query parameters that are understood when publishing
+var reservedParams = map[string]bool{
+	rawParam:       true,
+	timestampParam: true,
+}
+
+// jsonNumber matches values that are valid JSON number literals
+// Anything else (leading zeros, a leading +, hex, NaN, Inf) is kept as a string
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// queryToContent converts query parameters into the content of a yoink
+// Reserved parameters are left out and values have their types inferred unless _raw is set
+// Parameters given more than once become arrays and dotted keys become nested objects
+func queryToContent(queryParams url.Values) (map[string]interface{}, error) {
+	raw := false
+	if _, ok := queryParams[rawParam]; ok {
+		r, err := strconv.ParseBool(queryParams.Get(rawParam))
+		if err != nil {
+			return nil, errors.New("value of " + rawParam + " is not a boolean")
+		}
+		raw = r
+	}
+
+	// Go through the keys in order so conflicts are always reported the same way
+	keys := make([]string, 0, len(queryParams))
+	for k := range queryParams {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	content := map[string]interface{}{}
+	for _, k := range keys {
+		if strings.HasPrefix(k, reservedParamPrefix) {
+			if reservedParams[k] {
+				continue
+			}
+			return nil, errors.New("unknown reserved parameter " + k)
+		}
+
+		values := make([]interface{}, 0, len(queryParams[k]))
+		for _, v := range queryParams[k] {
+			if raw {
+				values = append(values, v)
+				continue
+			}
+			values = append(values, inferType(v))
+		}
+
+		var value interface{} = values
+		if len(values) == 1 {
+			value = values[0]
+		}
+
+		err := setPath(content, k, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return content, nil
+}
+
+// setPath stores value in content under a dotted key, creating nested objects along the way
+// It refuses to overwrite anything so gps=1&gps.lat=2 is reported instead of losing data
+func setPath(content map[string]interface{}, key string, value interface{}) error {
+	path := strings.Split(key, ".")
+	for _, p := range path {
+		if p == "" {
+			return errors.New("parameter " + key + " has an empty path segment")
+		}
+	}
+
+	current := content
+	for i, p := range path[:len(path)-1] {
+		existing, ok := current[p]
+		if !ok {
+			next := map[string]interface{}{}
+			current[p] = next
+			current = next
+			continue
+		}
+		next, ok := existing.(map[string]interface{})
+		if !ok {
+			return errors.New("parameter " + key + " conflicts with parameter " + strings.Join(path[:i+1], "."))
+		}
+		current = next
+	}
+
+	last := path[len(path)-1]
+	if _, ok := current[last]; ok {
+		return errors.New("parameter " + key + " conflicts with a nested parameter")
+	}
+	current[last] = value
+	return nil
+}
+
+// inferType converts a query parameter value to the JSON type it most likely represents
+// The rules are, in order:
+//   - null becomes a JSON null
+//   - true and false become booleans
+//   - integer literals that fit in 64 bits become integers
+//   - larger integer literals are kept exactly as they were written
+//   - other number literals that are finite become floats
+//   - everything else stays a string
+func inferType(v string) interface{} {
+	switch v {
+	case "null":
+		return nil
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+
+	if !jsonNumber.MatchString(v) {
+		return v
+	}
+	if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return i
+	}
+	if !strings.ContainsAny(v, ".eE") {
+		return json.Number(v)
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil && !math.IsInf(f, 0) {
+		return f
+	}
+	return v
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// TestInferType checks the type inference rules for query parameter values
+func TestInferType(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected interface{}
+	}{
+		{"null", nil},
+		{"true", true},
+		{"false", false},
+		{"True", "True"},
+		{"7", int64(7)},
+		{"-7", int64(-7)},
+		{"0", int64(0)},
+		{"666.666", 666.666},
+		{"1e3", 1000.0},
+		{"-0.5", -0.5},
+		{"99999999999999999999", json.Number("99999999999999999999")},
+		{"007", "007"},
+		{"+5", "+5"},
+		{"0x10", "0x10"},
+		{"NaN", "NaN"},
+		{"Inf", "Inf"},
+		{"1e999", "1e999"},
+		{".5", ".5"},
+		{"discard", "discard"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		got := inferType(tt.value)
+		if got != tt.expected {
+			t.Errorf("inferType(%q): expected %#v got %#v", tt.value, tt.expected, got)
+		}
+	}
+}
+
+// TestQueryToContent checks that query parameters are converted and escaped correctly
+func TestQueryToContent(t *testing.T) {
+	queryParams := url.Values{
+		"num":     {"666.666"},
+		"threads": {"7"},
+		"zooted":  {"false"},
+		`sneaky"`: {`value","injected":"yes`},
+	}
+	content, err := queryToContent(queryParams)
+	if err != nil {
+		t.Fatalf("converting query parameters failed: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"num":     666.666,
+		"threads": int64(7),
+		"zooted":  false,
+		`sneaky"`: `value","injected":"yes`,
+	}
+	if !reflect.DeepEqual(content, expected) {
+		t.Fatalf("expected %#v got %#v", expected, content)
+	}
+
+	// Quotes must not be able to add fields to the stored JSON
+	encoded, err := json.Marshal(content)
+	if err != nil {
+		t.Fatalf("encoding content failed: %v", err)
+	}
+	decoded := map[string]interface{}{}
+	err = json.Unmarshal(encoded, &decoded)
+	if err != nil {
+		t.Fatalf("decoding content failed: %v", err)
+	}
+	if _, ok := decoded["injected"]; ok || len(decoded) != 4 {
+		t.Fatalf("content was not escaped correctly: %s", encoded)
+	}
+}
+
+// TestQueryToContentRaw checks that _raw keeps every value as a string
+func TestQueryToContentRaw(t *testing.T) {
+	queryParams := url.Values{
+		"num":   {"666.666"},
+		"flag":  {"true"},
+		"empty": {"null"},
+		"_raw":  {"1"},
+	}
+	content, err := queryToContent(queryParams)
+	if err != nil {
+		t.Fatalf("converting query parameters failed: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"num":   "666.666",
+		"flag":  "true",
+		"empty": "null",
+	}
+	if !reflect.DeepEqual(content, expected) {
+		t.Fatalf("expected %#v got %#v", expected, content)
+	}
+}
+
+// TestQueryToContentStructured checks that repeated parameters and dotted keys produce arrays and objects
+func TestQueryToContentStructured(t *testing.T) {
+	queryParams := url.Values{
+		"reading":     {"1", "2.5", "high"},
+		"gps.lat":     {"1.2"},
+		"gps.lon":     {"3.4"},
+		"gps.fix.ok":  {"true"},
+		"gps.fix.sat": {"7", "9"},
+		"name":        {"home"},
+	}
+	content, err := queryToContent(queryParams)
+	if err != nil {
+		t.Fatalf("converting query parameters failed: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"reading": []interface{}{int64(1), 2.5, "high"},
+		"gps": map[string]interface{}{
+			"lat": 1.2,
+			"lon": 3.4,
+			"fix": map[string]interface{}{
+				"ok":  true,
+				"sat": []interface{}{int64(7), int64(9)},
+			},
+		},
+		"name": "home",
+	}
+	if !reflect.DeepEqual(content, expected) {
+		t.Fatalf("expected %#v got %#v", expected, content)
+	}
+}
+
+// TestQueryToContentErrors checks that invalid and conflicting parameters are refused
+func TestQueryToContentErrors(t *testing.T) {
+	tests := []url.Values{
+		{"_raw": {"maybe"}},
+		{"_unknown": {"1"}},
+		{"gps": {"1"}, "gps.lat": {"2"}},
+		{"gps.lat": {"1"}, "gps.lat.deg": {"2"}},
+		{"gps..lat": {"1"}},
+		{".lat": {"1"}},
+		{"lat.": {"1"}},
+	}
+
+	for _, queryParams := range tests {
+		_, err := queryToContent(queryParams)
+		if err == nil {
+			t.Errorf("expected error for %v", queryParams)
+		}
+	}
+}
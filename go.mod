@@ -5,6 +5,9 @@ go 1.18
 require (
 	github.com/carlmjohnson/versioninfo v0.22.4
 	github.com/go-chi/chi/v5 v5.0.7
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	github.com/gorilla/websocket v1.5.0
+	go.etcd.io/bbolt v1.3.6
 	modernc.org/sqlite v1.19.5
 )
 
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultGroupCommitWindow is how long publishes are collected before committing them when none is configured
+// Publishes that come in while a group is being committed are grouped anyway, so by default there's no waiting
+const defaultGroupCommitWindow = 0
+
+// maxGroupCommitYoinks is how many yoinks are collected before committing them without waiting for the rest of the window
+const maxGroupCommitYoinks = 1000
+
+// errStoreClosed is returned when publishing to a group commit store that has been closed
+var errStoreClosed = errors.New("store is closed")
+
+// groupCommitStore collects the publishes that come in at about the same time and commits them in one transaction
+// Every commit waits for the disk, so committing many yoinks at once publishes a lot more of them per second
+// Everything but publishing goes straight to the store it wraps
+type groupCommitStore struct {
+	Store
+	window    time.Duration
+	requests  chan *publishRequest
+	closed    chan struct{} // closed by Close to stop run
+	stopped   chan struct{} // closed by run once it's done committing
+	closeOnce sync.Once
+}
+
+// publishRequest is a call to Publish waiting for its yoinks to be committed
+type publishRequest struct {
+	pending []pendingYoink
+	done    chan publishResult // buffered so committing never waits for the caller
+}
+
+// publishResult is what a call to Publish returns
+type publishResult struct {
+	yoinks []*Yoink
+	err    error
+}
+
+// newGroupCommitStore wraps a store so publishes are collected for window before they are committed
+// A window of 0 only groups the publishes that came in while the previous group was being committed
+func newGroupCommitStore(store Store, window time.Duration) *groupCommitStore {
+	g := &groupCommitStore{
+		Store:    store,
+		window:   window,
+		requests: make(chan *publishRequest),
+		closed:   make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go g.run()
+	return g
+}
+
+// Close stops committing once the group being committed is done, later publishes fail with errStoreClosed
+// The store it wraps is left open
+func (g *groupCommitStore) Close() error {
+	g.closeOnce.Do(func() { close(g.closed) })
+	<-g.stopped
+	return nil
+}
+
+// Publish waits for the yoinks to be committed along with the others of their group and returns them as they were stored
+// The yoinks of a single call are still stored atomically
+func (g *groupCommitStore) Publish(ctx context.Context, pending []pendingYoink) ([]*Yoink, error) {
+	req := &publishRequest{pending: pending, done: make(chan publishResult, 1)}
+	select {
+	case g.requests <- req:
+	case <-g.closed:
+		return nil, errStoreClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	// Once it's been handed over the yoinks might be stored, so the caller finds out either way
+	res := <-req.done
+	return res.yoinks, res.err
+}
+
+// run collects publishes into groups and commits them, one group at a time
+func (g *groupCommitStore) run() {
+	defer close(g.stopped)
+	for {
+		select {
+		case req := <-g.requests:
+			g.commit(g.collect(req))
+		case <-g.closed:
+			return
+		}
+	}
+}
+
+// collect groups a publish with the ones that come in during the window, or the ones already waiting if there's no window
+func (g *groupCommitStore) collect(req *publishRequest) []*publishRequest {
+	group := []*publishRequest{req}
+	size := len(req.pending)
+	if g.window == 0 {
+		for size < maxGroupCommitYoinks {
+			select {
+			case req := <-g.requests:
+				group = append(group, req)
+				size += len(req.pending)
+			default:
+				return group
+			}
+		}
+		return group
+	}
+
+	timer := time.NewTimer(g.window)
+	defer timer.Stop()
+	for size < maxGroupCommitYoinks {
+		select {
+		case req := <-g.requests:
+			group = append(group, req)
+			size += len(req.pending)
+		case <-timer.C:
+			return group
+		}
+	}
+	return group
+}
+
+// commit stores the yoinks of a group in one transaction and hands every caller its own yoinks
+func (g *groupCommitStore) commit(group []*publishRequest) {
+	pending := []pendingYoink{}
+	for _, req := range group {
+		pending = append(pending, req.pending...)
+	}
+	yoinks, err := g.Store.Publish(context.Background(), pending)
+
+	// A bad publish shouldn't fail the ones that happened to be grouped with it, so they are committed on their own
+	if err != nil && len(group) > 1 {
+		for _, req := range group {
+			yoinks, err := g.Store.Publish(context.Background(), req.pending)
+			req.done <- publishResult{yoinks: yoinks, err: err}
+		}
+		return
+	}
+
+	for _, req := range group {
+		if err != nil {
+			req.done <- publishResult{err: err}
+			continue
+		}
+		n := len(req.pending)
+		req.done <- publishResult{yoinks: yoinks[:n:n]}
+		yoinks = yoinks[n:]
+	}
+}
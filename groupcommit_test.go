@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStore counts the calls to Publish of the store it wraps and fails the ones with a yoink for the topic bad
+type countingStore struct {
+	Store
+	publishes int32
+}
+
+func (c *countingStore) Publish(ctx context.Context, pending []pendingYoink) ([]*Yoink, error) {
+	atomic.AddInt32(&c.publishes, 1)
+	for _, p := range pending {
+		if p.topic == "bad" {
+			return nil, errors.New("bad topic")
+		}
+	}
+	return c.Store.Publish(ctx, pending)
+}
+
+func TestGroupCommit(t *testing.T) {
+	inner := &countingStore{Store: newMemoryStore(defaultMemoryMaxYoinks)}
+	store := newGroupCommitStore(inner, 50*time.Millisecond)
+
+	// Every caller gets its own yoinks back even though they are committed together
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			content := []byte(`{"i":` + strconv.Itoa(i) + `}`)
+			yoinks, err := store.Publish(context.Background(), []pendingYoink{{topic: "testtopic", content: content}, {topic: "othertopic", content: content}})
+			if err != nil {
+				t.Errorf("publishing failed: %v", err)
+				return
+			}
+			if len(yoinks) != 2 || yoinks[0].Topic != "testtopic" || yoinks[1].Topic != "othertopic" || yoinks[1].Content["i"] != json.Number(strconv.Itoa(i)) {
+				t.Errorf("expected the yoinks of publish %d got %d yoinks", i, len(yoinks))
+			}
+		}(i)
+	}
+	wg.Wait()
+	if publishes := atomic.LoadInt32(&inner.publishes); publishes >= 10 {
+		t.Fatalf("expected publishes to be committed together got %d commits", publishes)
+	}
+	if count := len(inner.Store.(*memoryStore).topics["testtopic"]); count != 10 {
+		t.Fatalf("expected 10 yoinks got %d", count)
+	}
+
+	// A failing publish only fails its own caller
+	errs := make(chan error, 2)
+	for _, topic := range []string{"bad", "testtopic"} {
+		go func(topic string) {
+			_, err := store.Publish(context.Background(), []pendingYoink{{topic: topic, content: []byte(`{}`)}})
+			errs <- err
+		}(topic)
+	}
+	failed := 0
+	for i := 0; i < 2; i++ {
+		if <-errs != nil {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("expected 1 publish to fail got %d", failed)
+	}
+	if count := len(inner.Store.(*memoryStore).topics["testtopic"]); count != 11 {
+		t.Fatalf("expected 11 yoinks got %d", count)
+	}
+
+	// Publishing stops once the store is closed, and closing it again is fine
+	store.Close()
+	store.Close()
+	_, err := store.Publish(context.Background(), []pendingYoink{{topic: "testtopic", content: []byte(`{}`)}})
+	if err != errStoreClosed {
+		t.Fatalf("expected %v got %v", errStoreClosed, err)
+	}
+}
+
+// benchmarkPublish publishes yoinks from many goroutines at once, like many devices publishing to the same server
+func benchmarkPublish(b *testing.B, store func() Store) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		b.Fatalf("buildup failed: %v", err)
+	}
+	s := store()
+	content := []byte(`{"tempreading":25}`)
+
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, err := s.Publish(context.Background(), []pendingYoink{{topic: "testtopic", content: content}})
+			if err != nil {
+				b.Errorf("publishing failed: %v", err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+
+	if closer, ok := s.(io.Closer); ok {
+		closer.Close()
+	}
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		b.Fatalf("teardown failed: %v", err)
+	}
+}
+
+func BenchmarkPublishSQLite(b *testing.B) {
+	benchmarkPublish(b, func() Store { return newSQLiteStore(db, db) })
+}
+
+func BenchmarkPublishSQLiteGroupCommit(b *testing.B) {
+	benchmarkPublish(b, func() Store { return newGroupCommitStore(newSQLiteStore(db, db), defaultGroupCommitWindow) })
+}
+
+// newBenchmarkBoltStore opens a bbolt store in a directory that's removed once the benchmark is done
+func newBenchmarkBoltStore(b *testing.B) *boltStore {
+	store, err := newBoltStore(filepath.Join(b.TempDir(), "yoinker.bolt"))
+	if err != nil {
+		b.Fatalf("opening bbolt failed: %v", err)
+	}
+	b.Cleanup(func() { store.db.Close() })
+	return store
+}
+
+func BenchmarkPublishBolt(b *testing.B) {
+	benchmarkPublish(b, func() Store { return newBenchmarkBoltStore(b) })
+}
+
+func BenchmarkPublishBoltGroupCommit(b *testing.B) {
+	benchmarkPublish(b, func() Store { return newGroupCommitStore(newBenchmarkBoltStore(b), defaultGroupCommitWindow) })
+}
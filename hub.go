@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sync"
+)
+
+// subscriptionBuffer is how many yoinks a subscriber can fall behind before it's dropped
+const subscriptionBuffer = 64
+
+// yoinkHub passes every stored yoink to the subscribers of its topic
+var yoinkHub = newHub()
+
+// hub is an in-process publish/subscribe hub for yoinks
+type hub struct {
+	mu   sync.Mutex
+	subs map[string]map[*subscription]struct{} // subscriptions by topic
+}
+
+// subscription receives the yoinks stored for its topics
+type subscription struct {
+	topics    map[string]struct{}
+	yoinks    chan *Yoink
+	dropped   chan struct{} // closed when the subscriber fell too far behind and was removed from the hub
+	isDropped bool          // guarded by the lock of the hub
+}
+
+// newHub creates an empty hub
+func newHub() *hub {
+	return &hub{subs: map[string]map[*subscription]struct{}{}}
+}
+
+// subscribe starts receiving the yoinks stored for the topics
+// The subscription must be passed to unsubscribe when it's no longer used
+func (h *hub) subscribe(topics ...string) *subscription {
+	s := &subscription{
+		topics:  map[string]struct{}{},
+		yoinks:  make(chan *Yoink, subscriptionBuffer),
+		dropped: make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, topic := range topics {
+		h.add(s, topic)
+	}
+	return s
+}
+
+// unsubscribe stops the subscription from receiving any more yoinks
+func (h *hub) unsubscribe(s *subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(s)
+}
+
+// addTopics starts receiving the yoinks stored for more topics
+func (h *hub) addTopics(s *subscription, topics ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s.isDropped {
+		return
+	}
+	for _, topic := range topics {
+		h.add(s, topic)
+	}
+}
+
+// removeTopics stops receiving the yoinks stored for some topics
+func (h *hub) removeTopics(s *subscription, topics ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, topic := range topics {
+		h.removeTopic(s, topic)
+	}
+}
+
+// publish passes a yoink to the subscribers of its topic without waiting for them
+// Subscribers that can't keep up are dropped so they can catch up from the database instead
+func (h *hub) publish(y *Yoink) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs[y.Topic] {
+		select {
+		case s.yoinks <- y:
+		default:
+			h.remove(s)
+			s.isDropped = true
+			close(s.dropped)
+		}
+	}
+}
+
+// add subscribes s to topic, the lock must be held
+func (h *hub) add(s *subscription, topic string) {
+	if h.subs[topic] == nil {
+		h.subs[topic] = map[*subscription]struct{}{}
+	}
+	h.subs[topic][s] = struct{}{}
+	s.topics[topic] = struct{}{}
+}
+
+// remove unsubscribes s from all of its topics, the lock must be held
+func (h *hub) remove(s *subscription) {
+	for topic := range s.topics {
+		h.removeTopic(s, topic)
+	}
+}
+
+// removeTopic unsubscribes s from topic, the lock must be held
+func (h *hub) removeTopic(s *subscription, topic string) {
+	delete(h.subs[topic], s)
+	if len(h.subs[topic]) == 0 {
+		delete(h.subs, topic)
+	}
+	delete(s.topics, topic)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestHub checks that yoinks reach the subscribers of their topic only
+func TestHub(t *testing.T) {
+	h := newHub()
+	a := h.subscribe("a")
+	ab := h.subscribe("a", "b")
+	defer h.unsubscribe(a)
+	defer h.unsubscribe(ab)
+
+	h.publish(&Yoink{ID: 1, Topic: "a"})
+	h.publish(&Yoink{ID: 2, Topic: "b"})
+	h.publish(&Yoink{ID: 3, Topic: "c"})
+
+	if y := <-a.yoinks; y.ID != 1 {
+		t.Fatalf("expected yoink 1 got %d", y.ID)
+	}
+	if len(a.yoinks) != 0 {
+		t.Fatalf("subscriber received yoinks of other topics")
+	}
+	if y := <-ab.yoinks; y.ID != 1 {
+		t.Fatalf("expected yoink 1 got %d", y.ID)
+	}
+	if y := <-ab.yoinks; y.ID != 2 {
+		t.Fatalf("expected yoink 2 got %d", y.ID)
+	}
+
+	h.unsubscribe(a)
+	h.publish(&Yoink{ID: 4, Topic: "a"})
+	if len(a.yoinks) != 0 {
+		t.Fatalf("unsubscribed subscriber received a yoink")
+	}
+}
+
+// TestHubDropsSlowSubscribers checks that a subscriber that falls behind is dropped instead of blocking
+func TestHubDropsSlowSubscribers(t *testing.T) {
+	h := newHub()
+	s := h.subscribe("a")
+	defer h.unsubscribe(s)
+
+	for i := 0; i <= subscriptionBuffer; i++ {
+		h.publish(&Yoink{ID: int64(i), Topic: "a"})
+	}
+
+	select {
+	case <-s.dropped:
+	default:
+		t.Fatalf("slow subscriber was not dropped")
+	}
+	if len(h.subs) != 0 {
+		t.Fatalf("dropped subscriber is still in the hub")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxHeartbeatInterval is how often a comment is sent to idle listeners to keep the connection open
+// when writeTimeout leaves enough room for it
+const maxHeartbeatInterval = 15 * time.Second
+
+// heartbeatInterval returns how often idle listeners get a heartbeat when responses have timeout to be written
+// Every write pushes the write deadline back, so heartbeats have to come well within it or idle streams are closed
+func heartbeatInterval(timeout time.Duration) time.Duration {
+	interval := timeout / 2
+	if interval > maxHeartbeatInterval {
+		return maxHeartbeatInterval
+	}
+	if interval < time.Millisecond {
+		return time.Millisecond
+	}
+	return interval
+}
+
+// ListenForYoinksFromTopic sends the yoinks of a topic to the client as Server-Sent Events as they are stored
+// Clients that reconnect with the Last-Event-ID header, or the last_id query parameter, get the yoinks
+// stored in the meantime before any new ones
+func (s *server) ListenForYoinksFromTopic(w http.ResponseWriter, r *http.Request) {
+	// Validate topic name
+	topic := chi.URLParam(r, "topic")
+	if topic == "" {
+		e := NewHTTPError("topic is empty", http.StatusBadRequest, "Error validating topic name")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	// Parse and validate the id of the last yoink the client received
+	lastID := int64(0)
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last_id")
+	}
+	if value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || id < 0 {
+			e := NewHTTPError("last event id is not a positive number", http.StatusBadRequest, "Error validating last event id")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+		lastID = id
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		e := NewHTTPError("response can't be streamed", http.StatusInternalServerError, "Error setting up event stream")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	// Subscribe before catching up so nothing stored in between is missed
+	sub := yoinkHub.subscribe(topic)
+	defer yoinkHub.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // stop reverse proxies from buffering events
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(y *Yoink) error {
+		data, err := json.Marshal(y)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: yoink\ndata: %s\n\n", y.ID, data)
+		if err != nil {
+			return err
+		}
+		flusher.Flush()
+		extendWriteDeadline(r, writeTimeout)
+		return nil
+	}
+
+	// Send whatever was stored after the last yoink the client received
+	if lastID > 0 {
+		it, err := s.store.After(r.Context(), topic, lastID)
+		if err != nil {
+			return
+		}
+		defer it.Close()
+		for it.Next() {
+			y, err := it.Yoink()
+			if err != nil {
+				return
+			}
+			err = send(y)
+			if err != nil {
+				return
+			}
+			lastID = y.ID
+		}
+		if it.Err() != nil {
+			return
+		}
+		it.Close()
+	}
+
+	// Then send new yoinks as they are stored, skipping the ones that were already caught up on
+	heartbeat := time.NewTicker(heartbeatInterval(writeTimeout))
+	defer heartbeat.Stop()
+	for {
+		select {
+		case y := <-sub.yoinks:
+			if y.ID <= lastID {
+				continue
+			}
+			if send(y) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			_, err := w.Write([]byte(": heartbeat\n\n"))
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+			extendWriteDeadline(r, writeTimeout)
+		case <-sub.dropped:
+			// The client fell behind, ending the stream makes it reconnect and catch up
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
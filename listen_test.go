@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is a Server-Sent Event as read by a test client
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// readEvents sends the events read from an event stream to a channel until the stream ends
+func readEvents(reader *bufio.Reader) <-chan sseEvent {
+	events := make(chan sseEvent)
+	go func() {
+		defer close(events)
+		e := sseEvent{}
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				if e.data != "" {
+					events <- e
+				}
+				e = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				e.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				e.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				e.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return events
+}
+
+// nextEvent waits for the next event of a stream
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatalf("event stream ended")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for event")
+	}
+	return sseEvent{}
+}
+
+// waitForListeners waits until a topic has the given number of subscribers
+func waitForListeners(t *testing.T, topic string, count int) {
+	for i := 0; i < 500; i++ {
+		yoinkHub.mu.Lock()
+		n := len(yoinkHub.subs[topic])
+		yoinkHub.mu.Unlock()
+		if n == count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("topic %s never got %d listeners", topic, count)
+}
+
+func TestListenForYoinksFromTopic(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+	srv := httptest.NewServer(setupRouter(testServer()))
+	defer srv.Close()
+
+	first, err := publishYoink("testtopic", "n=1")
+	if err != nil {
+		t.Fatalf("publish yoink failed: %v", err)
+	}
+	second, err := publishYoink("testtopic", "n=2")
+	if err != nil {
+		t.Fatalf("publish yoink failed: %v", err)
+	}
+
+	// Resuming after the first yoink replays the second one
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/yoinks/testtopic/events", nil)
+	if err != nil {
+		t.Fatalf("creating request failed: %v", err)
+	}
+	req.Header.Set("Last-Event-ID", strconv.FormatInt(first.ID, 10))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("wrong content type %s", res.Header.Get("Content-Type"))
+	}
+	events := readEvents(bufio.NewReader(res.Body))
+
+	e := nextEvent(t, events)
+	if e.id != strconv.FormatInt(second.ID, 10) || e.event != "yoink" {
+		t.Fatalf("expected replay of yoink %d got %#v", second.ID, e)
+	}
+
+	// New yoinks arrive as they are published, on both the HAPI and REST routes
+	hapi, err := http.Get(srv.URL + "/listen/for/yoinks/from/testtopic")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer hapi.Body.Close()
+	hapiEvents := readEvents(bufio.NewReader(hapi.Body))
+	waitForListeners(t, "testtopic", 2)
+
+	third, err := publishYoink("testtopic", "n=3")
+	if err != nil {
+		t.Fatalf("publish yoink failed: %v", err)
+	}
+	for _, ch := range []<-chan sseEvent{events, hapiEvents} {
+		e = nextEvent(t, ch)
+		y := &Yoink{}
+		err = json.Unmarshal([]byte(e.data), y)
+		if err != nil {
+			t.Fatalf("decoding event data failed: %v", err)
+		}
+		if y.ID != third.ID || y.Content["n"] != 3.0 {
+			t.Fatalf("expected yoink %d got %#v", third.ID, y)
+		}
+	}
+
+	// Yoinks of other topics are not sent
+	_, err = publishYoink("othertopic", "n=4")
+	if err != nil {
+		t.Fatalf("publish yoink failed: %v", err)
+	}
+	publishMany(t, "testtopic", 1)
+	e = nextEvent(t, events)
+	if !strings.Contains(e.data, `"topic":"testtopic"`) {
+		t.Fatalf("received yoink of another topic: %s", e.data)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+func TestHeartbeatInterval(t *testing.T) {
+	expected := map[time.Duration]time.Duration{
+		defaultWriteTimeout: 10 * time.Second,
+		time.Minute:         maxHeartbeatInterval,
+		5 * time.Second:     2500 * time.Millisecond,
+		time.Nanosecond:     time.Millisecond,
+	}
+	for timeout, interval := range expected {
+		if got := heartbeatInterval(timeout); got != interval {
+			t.Errorf("expected heartbeats every %s with a write timeout of %s got %s", interval, timeout, got)
+		}
+	}
+}
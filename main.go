@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"strconv"
@@ -19,13 +23,49 @@ import (
 )
 
 // db is a spooky global variable to access the database
+// Yoinks are only accessed through the Store of the server, everything else still uses it directly
 var db *sql.DB
 
+// readDB is the client of the same database that can only read, nil when there's none and db is used instead
+var readDB *sql.DB
+
+// readPool returns the client to use for lookups that never write
+func readPool() *sql.DB {
+	if readDB != nil {
+		return readDB
+	}
+	return db
+}
+
+// server holds what the handlers need to serve requests
+type server struct {
+	store  Store
+	alerts chan *Yoink // yoinks waiting for the alert rules of their topic, nil evaluates them while publishing
+}
+
+// newServer returns a server that keeps yoinks in the store
+func newServer(store Store) *server {
+	return &server{store: store}
+}
+
+// defaultMaxBodySize is the request body size limit in bytes used when none is configured
+const defaultMaxBodySize = 1 << 20
+
+// maxBodySize is the largest request body in bytes that will be accepted
+var maxBodySize int64 = defaultMaxBodySize
+
+// defaultMaxBatchBodySize is the batch request body size limit in bytes used when none is configured
+const defaultMaxBatchBodySize = 16 << 20
+
+// maxBatchBodySize is the largest batch request body in bytes that will be accepted
+var maxBatchBodySize int64 = defaultMaxBatchBodySize
+
 type Yoink struct {
-	ID        int64                  `json:"id"`
-	Topic     string                 `json:"topic"`
-	Timestamp string                 `json:"timestamp"` // time.Time errors out somewhere so leave out for now Timestamp time.Time `json:"timestamp"`
-	Content   map[string]interface{} `json:"content"`
+	ID         int64                  `json:"id"`
+	Topic      string                 `json:"topic"`
+	Timestamp  time.Time              `json:"timestamp"`   // serialized as RFC3339 with up to nanosecond precision
+	ReceivedAt time.Time              `json:"received_at"` // when the server received the yoink, which may differ from a supplied timestamp
+	Content    map[string]interface{} `json:"content"`     // numbers are json.Number so they keep their precision
 	//TODO: figure out how content generated from query params should be handled
 }
 
@@ -65,6 +105,15 @@ func NewHTTPError(err string, status int, detail string) error {
 	}
 }
 
+// asHTTPError returns the HTTPError in err, or an internal server error if it has none
+func asHTTPError(err error) *HTTPError {
+	e := &HTTPError{}
+	if !errors.As(err, &e) {
+		e = &HTTPError{Cause: err.Error(), Detail: "Internal Server Error", Status: http.StatusInternalServerError}
+	}
+	return e
+}
+
 // HTML for the quickstart page as a template string
 var quickstartHTML = `<!DOCTYPE html>
 <html>
@@ -92,7 +141,8 @@ var quickstartHTML = `<!DOCTYPE html>
 				{
 				  "id": 1,
 				  "topic": "demoESP32",
-				  "timestamp": "2022-10-26T11:21:11Z",
+				  "timestamp": "2022-10-26T11:21:11.123Z",
+				  "received_at": "2022-10-26T11:21:11.123Z",
 				  "content": {
 				    "name": "home",
 				    "tempreading": 25.7
@@ -117,7 +167,8 @@ var quickstartHTML = `<!DOCTYPE html>
 				{
 				  "id": 1,
 				  "topic": "demoESP32",
-				  "timestamp": "2022-10-26T11:21:11Z",
+				  "timestamp": "2022-10-26T11:21:11.123Z",
+				  "received_at": "2022-10-26T11:21:11.123Z",
 				  "content": {
 				    "name": "home",
 				    "tempreading": 25.7
@@ -144,116 +195,296 @@ func getVersionInfo(w http.ResponseWriter, _ *http.Request) {
 }
 
 // PublishForTopic adds a yoink to a topic
-func PublishForTopic(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
-		// Store query parameters
-		queryParams := r.URL.Query()
-
-		// Build the JSON using simple string concatenation
-		jsonContent := `{`
-		for k, z := range queryParams {
-			// if a parameter is specified twice, it can have 2 values
-			// I don't feel like dealing with the edge case so there you go
-			if len(z) != 1 {
-				e := NewHTTPError("Parameter with more than 1 value found", http.StatusBadRequest, "Bad Request")
-				w.WriteHeader(http.StatusBadRequest)
-				_ = json.NewEncoder(w).Encode(e)
-				return
-			}
-			v := z[0]
-
-			jsonContent += `"` + k + `":`
-			// Figure out the type of the value by trying to convert it
-			f, errf := strconv.ParseFloat(v, 64)
-			if errf == nil {
-				jsonContent += strconv.FormatFloat(f, 'f', -1, 64) + `,`
-				continue
-			}
-			i, erri := strconv.Atoi(v)
-			if erri == nil {
-				jsonContent += strconv.Itoa(i) + `,`
-				continue
-			}
-			if errf != nil && erri != nil {
-				jsonContent += `"` + v + `",`
-			}
-		}
-		jsonContent = strings.TrimSuffix(jsonContent, `,`)
-		jsonContent += `}`
+// The content is built from the query parameters and, for POST requests,
+// from the JSON object in the request body with the query parameters merged into it
+func (s *server) PublishForTopic(w http.ResponseWriter, r *http.Request) {
+	// Convert the query parameters into the content of the yoink, leaving out credentials
+	queryParams := r.URL.Query()
+	queryParams.Del(topicKeyParam)
+	queryParams.Del(accessTokenParam)
+	content, err := queryToContent(queryParams)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error parsing query parameters")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	jsonContent, err := json.Marshal(content)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error encoding content to JSON")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
 
-		// Validate JSON in case something was malformed
-		isValidJSON := json.Valid([]byte(jsonContent)) // Alternative for faster validation: https://github.com/valyala/fastjson
-		if !isValidJSON {
-			e := NewHTTPError("Invalid JSON", http.StatusBadRequest, "Bad Request")
-			w.WriteHeader(http.StatusBadRequest)
+	// Use the JSON object from the body as the content of POST requests
+	var bodyTimestamp json.RawMessage
+	if r.Method == http.MethodPost {
+		body, err := readJSONBody(r)
+		if err != nil {
+			e := &HTTPError{}
+			if !errors.As(err, &e) {
+				e = &HTTPError{Cause: err.Error(), Detail: "Bad Request", Status: http.StatusBadRequest}
+			}
+			w.WriteHeader(e.Status)
 			json.NewEncoder(w).Encode(e)
 			return
 		}
 
-		// Get topic name from the URL
-		topic := chi.URLParam(r, "topic")
-		if topic == "" {
-			e := NewHTTPError("Error parsing topic", http.StatusBadRequest, "Bad Request")
+		// The timestamp is not part of the content so take it out of the body
+		body, bodyTimestamp, err = extractBodyTimestamp(body)
+		if err != nil {
+			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error reading timestamp from request body")
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(e)
 			return
 		}
 
-		// Store the content and the topic (might change table structures in the future but we'll see)
-		rows, err := db.Query(
-			// Return all fields to be extra sure that what we send to the client is what was saved
-			`INSERT INTO Yoinks (topic, content) VALUES (?, ?) RETURNING id, topic, timestamp, content;`,
-			topic,
-			jsonContent,
-		)
+		// Query parameters take precedence over the fields of the body
+		merged, err := mergeJSONObjects(body, jsonContent)
 		if err != nil {
-			e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error inserting data to database")
-			w.WriteHeader(http.StatusInternalServerError)
+			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error merging query parameters into request body")
+			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(e)
 			return
 		}
+		jsonContent = merged
+	}
 
-		// Map the results from the database query to a struct
-		y := Yoink{} // Struct to be filled in by database results
-		for rows.Next() {
-			if rows.Err() != nil {
-				e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error encountered while iterating over returned row(s)")
-				w.WriteHeader(http.StatusBadRequest)
-				json.NewEncoder(w).Encode(e)
-				return
-			}
+	// Get topic name from the URL
+	topic := chi.URLParam(r, "topic")
+	if topic == "" {
+		e := NewHTTPError("Error parsing topic", http.StatusBadRequest, "Bad Request")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
 
-			tempJSON := "" // JSON is stored as text in sqlite and can't be directly mapped to a map[string]interface{}
-			err = rows.Scan(
-				&y.ID,
-				&y.Topic,
-				&y.Timestamp,
-				&tempJSON,
-			)
-			if err != nil {
-				e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error mapping query results to struct")
-				w.WriteHeader(http.StatusBadRequest)
-				json.NewEncoder(w).Encode(e)
-				return
-			}
-			err := json.NewDecoder(strings.NewReader(tempJSON)).Decode(&y.Content)
+	// Registered topics can only be published to with their key or a token
+	err = authorizeTopic(topic, requestCredentials(r))
+	if err != nil {
+		e := asHTTPError(err)
+		w.WriteHeader(e.Status)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	// Use the timestamp supplied by the publisher if there is one
+	timestamp, err := requestTimestamp(r, bodyTimestamp)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error validating timestamp")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	// Store the content and the topic
+	yoinks, err := s.storeYoinks(r.Context(), pendingYoink{topic: topic, timestamp: timestamp, content: jsonContent})
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error inserting data to database")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	// If everything has gone well, return the JSON-encoded Yoink struct
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(yoinks[0])
+}
+
+// storeYoinks stores yoinks, keeps their topics under their caps and lets listeners know about them
+// Everything that publishes yoinks goes through it
+func (s *server) storeYoinks(ctx context.Context, pending ...pendingYoink) ([]*Yoink, error) {
+	pending, err := withCaps(pending)
+	if err != nil {
+		return nil, err
+	}
+	yoinks, err := s.store.Publish(ctx, pending)
+	if err != nil {
+		return nil, err
+	}
+	for i, y := range yoinks {
+		s.yoinkStored(y, pending[i].fromAlert)
+	}
+	return yoinks, nil
+}
+
+// yoinkStored lets everything that reacts to new yoinks know about one that has just been stored
+// Alerts are not evaluated against alert rules, otherwise rules could keep setting each other off
+func (s *server) yoinkStored(y *Yoink, fromAlert bool) {
+	yoinkHub.publish(y)
+	enqueueWebhooks(y)
+	if !fromAlert {
+		s.queueAlerts(y)
+	}
+}
+
+// readJSONBody reads the request body and makes sure it holds a single JSON object
+// The body is returned compacted but otherwise as it was sent
+func readJSONBody(r *http.Request) ([]byte, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return nil, NewHTTPError("Content-Type must be application/json", http.StatusUnsupportedMediaType, "Unsupported Media Type")
+	}
+
+	body, err := readBody(r, maxBodySize)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := compactJSONObject(body)
+	if err != nil {
+		return nil, NewHTTPError("Request body must be a JSON object", http.StatusBadRequest, "Bad Request")
+	}
+	return content, nil
+}
+
+// compactJSONObject makes sure data holds a single JSON object and returns it without insignificant whitespace
+// Content is stored as a map so anything other than an object is refused
+func compactJSONObject(data []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' || !json.Valid(trimmed) {
+		return nil, errors.New("content must be a JSON object")
+	}
+
+	compacted := &bytes.Buffer{}
+	err := json.Compact(compacted, trimmed)
+	if err != nil {
+		return nil, err
+	}
+	return compacted.Bytes(), nil
+}
+
+// readBody reads the whole request body, refusing bodies larger than limit bytes
+func readBody(r *http.Request, limit int64) ([]byte, error) {
+	// Refuse early if the client announced a body that is too large
+	if r.ContentLength > limit {
+		return nil, NewHTTPError("Request body is larger than "+strconv.FormatInt(limit, 10)+" bytes", http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+	}
+
+	// Read one byte more than the limit to find out if the body is too large
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, NewHTTPError(err.Error(), http.StatusBadRequest, "Error reading request body")
+	}
+	if int64(len(body)) > limit {
+		return nil, NewHTTPError("Request body is larger than "+strconv.FormatInt(limit, 10)+" bytes", http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+	}
+	return body, nil
+}
+
+// mergeJSONObjects adds the fields of overrides to base, replacing any that already exist
+// Objects present in both are merged recursively so gps.lat can be set without losing gps.lon
+// Only the fields that are replaced change, the others keep their order and are copied as they were sent so numbers keep their precision
+func mergeJSONObjects(base, overrides []byte) ([]byte, error) {
+	extra, err := splitJSONObject(overrides)
+	if err != nil {
+		return nil, err
+	}
+	if len(extra) == 0 {
+		return base, nil
+	}
+
+	fields, err := splitJSONObject(base)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range extra {
+		i := lastJSONField(fields, e.name)
+		if i < 0 {
+			fields = append(fields, e)
+			continue
+		}
+		if isJSONObject(fields[i].value) && isJSONObject(e.value) {
+			merged, err := mergeJSONObjects(fields[i].value, e.value)
 			if err != nil {
-				e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error decoding content from JSON")
-				w.WriteHeader(http.StatusBadRequest)
-				json.NewEncoder(w).Encode(e)
-				return
+				return nil, err
 			}
+			fields[i].value = merged
+			continue
 		}
+		fields[i].value = e.value
+	}
+	return joinJSONObject(fields), nil
+}
 
-		// If everything has gone well, return the JSON-encoded Yoink struct
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(y)
+// jsonField is a field of a JSON object with its key and value as they were sent
+type jsonField struct {
+	name  string
+	key   []byte
+	value json.RawMessage
+}
+
+// splitJSONObject returns the fields of a JSON object in the order they were sent without decoding their values
+func splitJSONObject(data []byte) ([]jsonField, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token != json.Delim('{') {
+		return nil, errors.New("content must be a JSON object")
 	}
-	//TODO: add code to handle POST
+
+	fields := []jsonField{}
+	for decoder.More() {
+		start := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		name, _ := token.(string)
+		// The key is cut out of the data rather than encoded again, along with the comma before it
+		key := bytes.TrimLeft(data[start:decoder.InputOffset()], ", \t\r\n")
+		value := json.RawMessage{}
+		err = decoder.Decode(&value)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, jsonField{name: name, key: key, value: value})
+	}
+	_, err = decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// joinJSONObject puts fields back together into a JSON object
+func joinJSONObject(fields []jsonField) []byte {
+	object := &bytes.Buffer{}
+	object.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			object.WriteByte(',')
+		}
+		object.Write(f.key)
+		object.WriteByte(':')
+		object.Write(f.value)
+	}
+	object.WriteByte('}')
+	return object.Bytes()
+}
+
+// lastJSONField returns the index of the last field with a name, which is the one that counts when it's decoded, or -1 if there's none
+func lastJSONField(fields []jsonField, name string) int {
+	for i := len(fields) - 1; i >= 0; i-- {
+		if fields[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// isJSONObject reports whether a JSON value is an object
+func isJSONObject(value json.RawMessage) bool {
+	trimmed := bytes.TrimSpace(value)
+	return len(trimmed) > 0 && trimmed[0] == '{'
 }
 
 // GetLatestYoinkFromTopic returns the latest yoink for the provided topic
-func GetLatestYoinkFromTopic(w http.ResponseWriter, r *http.Request) {
+// With the wait query parameter it long-polls for a yoink newer than after_id or after (see parseWait)
+func (s *server) GetLatestYoinkFromTopic(w http.ResponseWriter, r *http.Request) {
 	// Get topic name from the URL
 	topic := chi.URLParam(r, "topic")
 	if topic == "" {
@@ -263,49 +494,30 @@ func GetLatestYoinkFromTopic(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retrieve all fields of the last inserted row for the specified topic
-	rows, err := db.Query(
-		// Return all fields to be extra sure that what we send to the client is what was saved
-		`SELECT id, topic, timestamp, content FROM yoinks WHERE topic = ? ORDER BY timestamp DESC LIMIT 1;`,
-		topic,
-	)
+	// Long-poll for a newer yoink if the client asked to wait
+	wait, cond, err := parseWait(r)
 	if err != nil {
-		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error getting data from database")
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error validating wait parameters")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(e)
 		return
 	}
+	if wait > 0 {
+		s.waitForYoink(w, r, topic, wait, cond)
+		return
+	}
 
-	// Map the results from the database query to a struct
-	y := Yoink{} // Struct to be filled in by database results
-	for rows.Next() {
-		if rows.Err() != nil {
-			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error accessing returned row")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(e)
-			return
-		}
-
-		tempJSON := "" // JSON is stored as text in sqlite and can't be directly mapped to a map[string]interface{}
-		err = rows.Scan(
-			&y.ID,
-			&y.Topic,
-			&y.Timestamp,
-			&tempJSON,
-		)
-		if err != nil {
-			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error mapping query results to struct")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(e)
-			return
-		}
-		err := json.NewDecoder(strings.NewReader(tempJSON)).Decode(&y.Content)
-		if err != nil {
-			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error decoding content from JSON")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(e)
-			return
-		}
+	// Retrieve the last inserted yoink for the specified topic
+	y, err := s.store.Latest(r.Context(), topic, waitCondition{})
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error getting data from database")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	// Topics without yoinks get an empty one
+	if y == nil {
+		y = &Yoink{}
 	}
 
 	// If everything has gone well, return the JSON-encoded Yoink struct
@@ -314,7 +526,9 @@ func GetLatestYoinkFromTopic(w http.ResponseWriter, r *http.Request) {
 }
 
 // getLastNumberOfYoinksFromTopic returns the latest/last specified number of yoinks for the provided topic
-func getLastNumberOfYoinksFromTopic(w http.ResponseWriter, r *http.Request) {
+// The since, until and order query parameters restrict the yoinks to a time range and set their order
+// and the yoinks can be streamed as described in parseStreamFormat
+func (s *server) getLastNumberOfYoinksFromTopic(w http.ResponseWriter, r *http.Request) {
 	// Validate topic name
 	topic := chi.URLParam(r, "topic")
 	if topic == "" {
@@ -340,52 +554,46 @@ func getLastNumberOfYoinksFromTopic(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retrieve all fields of the last inserted row for the specified topic
-	rows, err := db.Query(
-		// Return all fields to be extra sure that what we send to the client is what was saved
-		`SELECT id, topic, timestamp, content FROM yoinks WHERE topic = ? ORDER BY timestamp DESC LIMIT ?;`,
-		topic,
-		number,
-	)
+	// Parse and validate the time range
+	tr, err := parseTimeRange(r)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error validating time range")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	// Find out if the yoinks should be streamed
+	stream, ndjson, err := parseStreamFormat(r)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error validating stream format")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	// Retrieve the last inserted yoinks in the range for the specified topic
+	// The newest yoinks are always the ones picked, the requested order only applies to how they're returned
+	it, err := s.store.LastN(r.Context(), topic, num, tr)
 	if err != nil {
 		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error getting data from database")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(e)
 		return
 	}
+	defer it.Close()
 
-	yoinks := []*Yoink{}
-	// Map the results from the database query to a struct
-	for rows.Next() {
-		if rows.Err() != nil {
-			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error accessing returned row")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(e)
-			return
-		}
+	if stream {
+		streamYoinks(w, r, it, ndjson)
+		return
+	}
 
-		y := Yoink{}   // Struct to be filled in by database results
-		tempJSON := "" // JSON is stored as text in sqlite and can't be directly mapped to a map[string]interface{}
-		err = rows.Scan(
-			&y.ID,
-			&y.Topic,
-			&y.Timestamp,
-			&tempJSON,
-		)
-		if err != nil {
-			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error mapping query results to struct")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(e)
-			return
-		}
-		err := json.NewDecoder(strings.NewReader(tempJSON)).Decode(&y.Content)
-		if err != nil {
-			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error decoding content from JSON")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(e)
-			return
-		}
-		yoinks = append(yoinks, &y)
+	yoinks, err := collectYoinks(it)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error getting data from database")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
 	}
 
 	// If everything has gone well, return the JSON-encoded list of Yoink structs
@@ -393,8 +601,12 @@ func getLastNumberOfYoinksFromTopic(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(yoinks)
 }
 
-// GetAllYoinksFromTopic returns all yoinks for the provided topic
-func GetAllYoinksFromTopic(w http.ResponseWriter, r *http.Request) {
+// GetAllYoinksFromTopic returns all yoinks for the provided topic, one page at a time
+// The since, until and order query parameters restrict the yoinks to a time range and set their order
+// The limit query parameter sets the page size and the cursor one continues from a previous page,
+// with the cursor of the next page returned in the X-Next-Cursor and Link headers
+// Streamed responses (see parseStreamFormat) return every yoink after the cursor instead of a page
+func (s *server) GetAllYoinksFromTopic(w http.ResponseWriter, r *http.Request) {
 	// Validate and parse topic name and number
 	topic := chi.URLParam(r, "topic")
 	if topic == "" {
@@ -404,51 +616,74 @@ func GetAllYoinksFromTopic(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retrieve all fields of the last inserted row for the specified topic
-	rows, err := db.Query(
-		// Return all fields to be extra sure that what we send to the client is what was saved
-		`SELECT id, topic, timestamp, content FROM yoinks WHERE topic = ? ORDER BY timestamp DESC;`,
-		topic,
-	)
+	// Parse and validate the time range
+	tr, err := parseTimeRange(r)
 	if err != nil {
-		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error getting data from database")
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error validating time range")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(e)
 		return
 	}
 
-	yoinks := []*Yoink{}
-	// Map the results from the database query to a struct
-	for rows.Next() {
-		if rows.Err() != nil {
-			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error accessing returned row")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(e)
-			return
-		}
-
-		y := Yoink{}   // Struct to be filled in by database results
-		tempJSON := "" // JSON is stored as text in sqlite and can't be directly mapped to a map[string]interface{}
-		err = rows.Scan(
-			&y.ID,
-			&y.Topic,
-			&y.Timestamp,
-			&tempJSON,
-		)
+	// Parse and validate where the yoinks start
+	var after *pageCursor
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		c, err := decodeCursor(value)
 		if err != nil {
-			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error mapping query results to struct")
+			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error validating cursor")
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(e)
 			return
 		}
-		err := json.NewDecoder(strings.NewReader(tempJSON)).Decode(&y.Content)
+		after = &c
+	}
+
+	// Streamed yoinks aren't paginated since they don't have to fit in memory
+	stream, ndjson, err := parseStreamFormat(r)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error validating stream format")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	if stream {
+		it, err := s.store.All(r.Context(), topic, tr, after)
 		if err != nil {
-			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error decoding content from JSON")
+			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error getting data from database")
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(e)
 			return
 		}
-		yoinks = append(yoinks, &y)
+		defer it.Close()
+		streamYoinks(w, r, it, ndjson)
+		return
+	}
+
+	// Parse and validate the page size
+	limit, err := parsePageLimit(r)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error validating page limit")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	// Retrieve a page of yoinks in the range for the specified topic
+	// One yoink more than the limit is requested to find out if there is a next page
+	yoinks, err := s.store.Range(r.Context(), topic, tr, after, limit+1)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error getting data from database")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	// Point to the next page if there are yoinks left
+	if len(yoinks) > limit {
+		yoinks = yoinks[:limit]
+		next := encodeCursor(yoinks[len(yoinks)-1])
+		w.Header().Set("X-Next-Cursor", next)
+		w.Header().Set("Link", "<"+nextPageURL(r, next, limit)+`>; rel="next"`)
 	}
 
 	// If everything has gone well, return the JSON-encoded list of Yoink structs
@@ -458,11 +693,23 @@ func GetAllYoinksFromTopic(w http.ResponseWriter, r *http.Request) {
 
 // SetupDB initializes the database and returns a client to it
 func SetupDB() (*sql.DB, error) {
-	dbPath := os.Getenv("DB_PATH")
-	if dbPath == "" {
-		dbPath = "yoink.db"
+	// Nothing is written to disk when yoinks are kept in memory, so neither are registered topics, webhooks and alert rules
+	pragmas, err := SetupSQLitePragmas()
+	if err != nil {
+		return nil, err
+	}
+	if SetupStorage() == storageMemory {
+		sqlite, err := openSQLite(":memory:", pragmas)
+		if err != nil {
+			return nil, err
+		}
+		// Every connection to :memory: gets a database of its own, so the same one has to be used for everything
+		sqlite.SetMaxOpenConns(1)
+		return prepareDB(sqlite)
 	}
 
+	dbPath := setupDBPath()
+
 	// Check if file exists and if not, create it
 	fileInfo, err := os.Stat(dbPath)
 	if err != nil {
@@ -476,33 +723,60 @@ func SetupDB() (*sql.DB, error) {
 		return nil, errors.New(dbPath + " is not a regular file")
 	}
 	// Since the file exists, use it for sqlite
-	sqlite, err := sql.Open("sqlite", dbPath)
+	sqlite, err := openSQLite(dbPath, pragmas)
 	if err != nil {
 		return nil, err
 	}
+	return prepareDB(sqlite)
+}
 
-	// Ping the database to make sure we can access it and use it
+// SetupReadDB opens a second client to the database set up by SetupDB that can only read
+// Reads then don't wait for connections that are busy writing, and WAL lets them run while a write is in progress
+func SetupReadDB() (*sql.DB, error) {
+	pragmas, err := SetupSQLitePragmas()
+	if err != nil {
+		return nil, err
+	}
+	sqlite, err := openSQLite(setupDBPath(), append(pragmas, "query_only=ON"))
+	if err != nil {
+		return nil, err
+	}
 	err = sqlite.Ping()
 	if err != nil {
+		sqlite.Close()
 		return nil, err
 	}
+	return sqlite, nil
+}
 
-	// Create schema
-	_, err = sqlite.Exec(`CREATE TABLE if not exists yoinks (
-		id INTEGER NOT NULL,
-		topic TEXT NOT NULL,
-		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-		content TEXT NOT NULL,
-		PRIMARY KEY (id AUTOINCREMENT)
-	);`)
+// setupDBPath returns the path of the database file
+func setupDBPath() string {
+	dbPath := os.Getenv("DB_PATH")
+	if dbPath == "" {
+		return "yoink.db"
+	}
+	return dbPath
+}
+
+// prepareDB makes sure an opened database can be used and brings its schema up to date
+func prepareDB(sqlite *sql.DB) (*sql.DB, error) {
+	// Ping the database to make sure we can access it and use it
+	err := sqlite.Ping()
 	if err != nil {
 		return nil, err
 	}
+
+	// Create the schema or bring it up to date
+	err = migrate(sqlite)
+	if err != nil {
+		return nil, err
+	}
+	yoinkCaps.reset()
 	return sqlite, nil
 }
 
 // setupRouter configures the handler that the server will use
-func setupRouter() http.Handler {
+func setupRouter(s *server) http.Handler {
 	// Create new chi router
 	r := chi.NewRouter()
 
@@ -511,6 +785,7 @@ func setupRouter() http.Handler {
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
+	r.Use(authenticate)
 
 	// Set up routes
 
@@ -538,21 +813,56 @@ func setupRouter() http.Handler {
 	// Quickstart endpoint to help users get started
 	r.Get("/quickstart", quickstart)
 
+	// WebSocket endpoint to publish and subscribe over a single connection
+	r.Get("/ws", s.ConnectWebSocket)
+
 	// HAPI endpoints
 	// more info at https://github.com/jheising/HAPI
-	r.Get("/publish/yoink/for/{topic}", PublishForTopic)
-	r.Get("/get/all/yoinks/from/{topic}", GetAllYoinksFromTopic)
-	r.Get("/get/latest/yoink/from/{topic}", GetLatestYoinkFromTopic)
-	r.Get("/get/last/{number}/yoinks/from/{topic}", getLastNumberOfYoinksFromTopic)
-	r.Get("/get/{number}/last/yoinks/from/{topic}", getLastNumberOfYoinksFromTopic)
-	r.Get("/get/latest/{number}/yoinks/from/{topic}", getLastNumberOfYoinksFromTopic)
-	r.Get("/get/{number}/latest/yoinks/from/{topic}", getLastNumberOfYoinksFromTopic)
+	r.Get("/publish/yoink/for/{topic}", s.PublishForTopic)
+	r.With(requireReadAccess).Get("/get/all/yoinks/from/{topic}", s.GetAllYoinksFromTopic)
+	r.With(requireReadAccess, writeTimeoutFor(maxWait+writeTimeout)).Get("/get/latest/yoink/from/{topic}", s.GetLatestYoinkFromTopic)
+	r.With(requireReadAccess).Get("/get/last/{number}/yoinks/from/{topic}", s.getLastNumberOfYoinksFromTopic)
+	r.With(requireReadAccess).Get("/get/{number}/last/yoinks/from/{topic}", s.getLastNumberOfYoinksFromTopic)
+	r.With(requireReadAccess).Get("/get/latest/{number}/yoinks/from/{topic}", s.getLastNumberOfYoinksFromTopic)
+	r.With(requireReadAccess).Get("/get/{number}/latest/yoinks/from/{topic}", s.getLastNumberOfYoinksFromTopic)
+	r.With(requireReadAccess).Get("/listen/for/yoinks/from/{topic}", s.ListenForYoinksFromTopic)
 
 	// REST API endpoints
-	r.Post("/yoink/{topic}", PublishForTopic) //TODO: expand PublishForTopic to handle POST correctly
-	r.Get("/yoink/{topic}", GetLatestYoinkFromTopic)
-	r.Get("/yoinks/{topic}/{number}", getLastNumberOfYoinksFromTopic)
-	r.Get("/yoinks/{topic}", GetAllYoinksFromTopic)
+	r.Post("/yoink/{topic}", s.PublishForTopic)
+	r.Post("/yoinks", s.PublishBatch)
+	r.Post("/yoinks/{topic}", s.PublishBatch)
+	r.With(requireReadAccess, writeTimeoutFor(maxWait+writeTimeout)).Get("/yoink/{topic}", s.GetLatestYoinkFromTopic)
+	r.With(requireReadAccess).Get("/yoinks/{topic}/{number}", s.getLastNumberOfYoinksFromTopic)
+	r.With(requireReadAccess).Get("/yoinks/{topic}", s.GetAllYoinksFromTopic)
+	r.With(requireReadAccess).Get("/yoinks/{topic}/events", s.ListenForYoinksFromTopic)
+
+	// Topic endpoints
+	r.Get("/topics/{topic}", GetTopic)
+	r.Post("/topics/{topic}/register", RegisterTopic)
+
+	// Only the owner of a registered topic can manage it
+	r.Group(func(r chi.Router) {
+		r.Use(requireTopicOwner)
+
+		r.Patch("/topics/{topic}", s.UpdateTopic)
+		r.Delete("/topics/{topic}/register", UnregisterTopic)
+		r.Delete("/yoinks/{topic}", s.DeleteTopicYoinks)
+
+		// Webhook and alert endpoints, topics that aren't registered have no owner to manage them or see where they deliver
+		r.Group(func(r chi.Router) {
+			r.Use(requireRegisteredTopic)
+
+			r.Post("/topics/{topic}/webhooks", CreateWebhook)
+			r.Get("/topics/{topic}/webhooks", GetWebhooks)
+			r.Delete("/topics/{topic}/webhooks/{id}", DeleteWebhook)
+			r.Get("/topics/{topic}/webhooks/{id}/deliveries", GetWebhookDeliveries)
+
+			// Alert endpoints, their webhooks are delivered like the ones above
+			r.Post("/topics/{topic}/alerts", CreateAlertRule)
+			r.Get("/topics/{topic}/alerts", GetAlertRules)
+			r.Delete("/topics/{topic}/alerts/{id}", DeleteAlertRule)
+		})
+	})
 
 	return r
 }
@@ -566,13 +876,173 @@ func SetupPort() string {
 	return port
 }
 
-func main() {
-	// Set up http router
-	r := setupRouter()
+// SetupMaxBodySize configures the largest request body in bytes that the app accepts
+func SetupMaxBodySize() int64 {
+	size, err := strconv.ParseInt(os.Getenv("DATAYOINKER_MAX_BODY_SIZE"), 10, 64)
+	if err != nil || size < 1 {
+		return defaultMaxBodySize
+	}
+	return size
+}
+
+// SetupWriteTimeout configures how long the server has to write a response
+func SetupWriteTimeout() time.Duration {
+	timeout, err := time.ParseDuration(os.Getenv("DATAYOINKER_WRITE_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		return defaultWriteTimeout
+	}
+	return timeout
+}
+
+// SetupMaxWait configures the longest a client can wait for a new yoink
+// The routes that support waiting get this much more time to write their response
+func SetupMaxWait() time.Duration {
+	wait, err := time.ParseDuration(os.Getenv("DATAYOINKER_MAX_WAIT"))
+	if err != nil || wait <= 0 {
+		return defaultMaxWait
+	}
+	return wait
+}
+
+// SetupAlertCheckInterval configures how often stale topics and pending alert rules are checked
+func SetupAlertCheckInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("DATAYOINKER_ALERT_CHECK_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return defaultAlertCheckInterval
+	}
+	return interval
+}
+
+// SetupRetention configures how long the yoinks of topics that aren't registered are kept
+// Without it they are kept forever
+func SetupRetention() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("DATAYOINKER_RETENTION"))
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// SetupRegisteredRetention configures how long the yoinks of registered topics are kept unless they set their own
+// Without it they are kept forever
+// Registering a topic never gets its yoinks deleted sooner, so it's never shorter than the retention of topics that aren't registered
+func SetupRegisteredRetention(unregistered time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv("DATAYOINKER_REGISTERED_RETENTION"))
+	if err != nil || d < 0 {
+		d = 0
+	}
+	if d > 0 && (unregistered == 0 || d < unregistered) {
+		log.Println("DATAYOINKER_REGISTERED_RETENTION is shorter than DATAYOINKER_RETENTION, keeping the yoinks of registered topics as long as the rest")
+		return unregistered
+	}
+	return d
+}
 
+// SetupRetentionInterval configures how often old yoinks are deleted
+func SetupRetentionInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("DATAYOINKER_RETENTION_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return defaultRetentionInterval
+	}
+	return interval
+}
+
+// SetupStorage configures where yoinks are kept, either sqlite, memory or bolt
+// DB_PATH=:memory: keeps them in memory as well
+func SetupStorage() string {
+	if os.Getenv("DB_PATH") == ":memory:" {
+		return storageMemory
+	}
+	switch storage := os.Getenv("DATAYOINKER_STORAGE"); storage {
+	case storageSQLite, storageMemory, storageBolt:
+		return storage
+	}
+	return storageSQLite
+}
+
+// SetupMemoryMaxYoinks configures how many yoinks of a topic are kept when they are kept in memory
+func SetupMemoryMaxYoinks() int {
+	maxYoinks, err := strconv.Atoi(os.Getenv("DATAYOINKER_MEMORY_MAX_YOINKS"))
+	if err != nil || maxYoinks < 1 {
+		return defaultMemoryMaxYoinks
+	}
+	return maxYoinks
+}
+
+// SetupBoltPath configures the path of the file yoinks are kept in when they are kept in bbolt
+func SetupBoltPath() string {
+	path := os.Getenv("DATAYOINKER_BOLT_PATH")
+	if path == "" {
+		return defaultBoltPath
+	}
+	return path
+}
+
+// SetupGroupCommitWindow configures how long publishes are collected before they are committed together
+// By default only the publishes that come in while the previous ones are being committed are grouped
+func SetupGroupCommitWindow() time.Duration {
+	window, err := time.ParseDuration(os.Getenv("DATAYOINKER_GROUP_COMMIT_WINDOW"))
+	if err != nil || window < 0 {
+		return defaultGroupCommitWindow
+	}
+	return window
+}
+
+// SetupSQLitePragmas configures the pragmas every connection to the database runs when it's opened
+// DATAYOINKER_SQLITE_PRAGMAS is a comma separated list like synchronous=NORMAL,cache_size=-64000 that is run after the defaults
+// A pragma that can't be used is an error rather than being left out, so the database isn't quietly set up differently than asked
+func SetupSQLitePragmas() ([]string, error) {
+	pragmas := append([]string{}, defaultSQLitePragmas...)
+	extra := os.Getenv("DATAYOINKER_SQLITE_PRAGMAS")
+	if extra == "" {
+		return pragmas, nil
+	}
+	for _, pragma := range strings.Split(extra, ",") {
+		pragma = strings.TrimSpace(pragma)
+		// Pragmas can't be passed as parameters, so anything that isn't a plain name and value is refused
+		if !sqlitePragma.MatchString(pragma) {
+			return nil, fmt.Errorf("DATAYOINKER_SQLITE_PRAGMAS has %q, which is not a pragma name optionally set to a value", pragma)
+		}
+		pragmas = append(pragmas, pragma)
+	}
+	return pragmas, nil
+}
+
+// SetupAllowPrivateWebhooks configures whether webhooks can be delivered to loopback, link-local and private addresses
+// It's meant for servers on a private network whose webhooks go to other services on it
+func SetupAllowPrivateWebhooks() bool {
+	allow, err := strconv.ParseBool(os.Getenv("DATAYOINKER_WEBHOOK_ALLOW_PRIVATE"))
+	return err == nil && allow
+}
+
+// SetupMaxBatchBodySize configures the largest batch request body in bytes that the app accepts
+func SetupMaxBatchBodySize() int64 {
+	size, err := strconv.ParseInt(os.Getenv("DATAYOINKER_MAX_BATCH_BODY_SIZE"), 10, 64)
+	if err != nil || size < 1 {
+		return defaultMaxBatchBodySize
+	}
+	return size
+}
+
+func main() {
 	// Set up http port
 	port := SetupPort()
 
+	// Set up request body size limits
+	maxBodySize = SetupMaxBodySize()
+	maxBatchBodySize = SetupMaxBatchBodySize()
+
+	// Set up timeouts before the router since routes use them
+	writeTimeout = SetupWriteTimeout()
+	maxWait = SetupMaxWait()
+
+	// Set up JWT verification, a broken configuration must not silently disable it
+	verifier, err := SetupJWT()
+	if err != nil {
+		log.Fatalln("failed setting up JWT authentication:", err)
+	}
+	tokenVerifier = verifier
+
 	// Set up database
 	sqlite, err := SetupDB()
 	if err != nil {
@@ -581,14 +1051,54 @@ func main() {
 	// assign database to global variable
 	db = sqlite
 
+	// Set up where yoinks are kept
+	var store Store
+	switch SetupStorage() {
+	case storageMemory:
+		store = newMemoryStore(SetupMemoryMaxYoinks())
+		log.Println("keeping yoinks in memory, they will be lost when the server stops")
+	case storageBolt:
+		boltStore, err := newBoltStore(SetupBoltPath())
+		if err != nil {
+			log.Fatalln("failed setting up bbolt:", err)
+		}
+		store = newGroupCommitStore(boltStore, SetupGroupCommitWindow())
+	default:
+		readDB, err = SetupReadDB()
+		if err != nil {
+			log.Fatalln("failed setting up database for reading:", err)
+		}
+		store = newGroupCommitStore(newSQLiteStore(db, readDB), SetupGroupCommitWindow())
+	}
+
+	// Set up the server and its http router
+	s := newServer(store)
+	r := setupRouter(s)
+
+	// Start delivering yoinks to webhooks now that the database is ready
+	allowPrivateWebhooks = SetupAllowPrivateWebhooks()
+	startWebhookWorkers()
+
+	// Evaluate alert rules in the background and check the ones that fire when nothing happens
+	s.startAlertWorker()
+	alertCheckInterval = SetupAlertCheckInterval()
+	s.startAlertChecker()
+
+	// Delete yoinks once they are older than the retention of their topic
+	retention = SetupRetention()
+	registeredRetention = SetupRegisteredRetention(retention)
+	retentionInterval = SetupRetentionInterval()
+	s.startRetention()
+
 	// Create server with timeouts set
 	srv := &http.Server{
 		Addr:              ":" + port,
 		Handler:           r,
 		ReadTimeout:       10 * time.Second,
 		ReadHeaderTimeout: 5 * time.Second,
-		WriteTimeout:      20 * time.Second,
+		WriteTimeout:      writeTimeout,
 		IdleTimeout:       30 * time.Second,
+		ConnContext:       saveConn, // lets streamed responses extend the write timeout
 	}
 
 	// Provide feedback about the server starting
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -47,8 +48,29 @@ func buildUp() (string, string, error) {
 	return initialPath, testPath, nil
 }
 
+// testServer returns a server that keeps yoinks in the database set up by the test
+func testServer() *server {
+	return newServer(newSQLiteStore(db, db))
+}
+
+// removeTestDB removes a test database along with the WAL files SQLite keeps next to it
+// A WAL file left behind would be applied to the next database created at the same path
+func removeTestDB(path string) error {
+	err := os.Remove(path)
+	if err != nil {
+		return err
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		err = os.Remove(path + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
 func tearDown(initialPath, testPath string) error {
-	err := os.Remove(testPath)
+	err := removeTestDB(testPath)
 	if err != nil {
 		return fmt.Errorf("cleaning up temporary test file failed: %w", err)
 	}
@@ -95,7 +117,7 @@ func TestSetupDB(t *testing.T) {
 		t.Fatalf("Setting up the database failed: %v", err)
 	}
 
-	err = os.Remove(testPath)
+	err = removeTestDB(testPath)
 	if err != nil {
 		t.Errorf("Cleaning up temporary test file failed: %v", err)
 	}
@@ -117,7 +139,7 @@ func TestPublishForTopic(t *testing.T) {
 
 	w := httptest.NewRecorder()
 
-	router := setupRouter()
+	router := setupRouter(testServer())
 	router.ServeHTTP(w, req)
 
 	res := w.Result()
@@ -151,7 +173,7 @@ func TestPublishForTopic(t *testing.T) {
 		t.Fatalf("4 wrong yoink returned: %#v", y)
 	}
 
-	err = os.Remove(testPath)
+	err = removeTestDB(testPath)
 	if err != nil {
 		t.Errorf("Cleaning up temporary test file failed: %v", err)
 	}
@@ -179,7 +201,7 @@ func TestGetAllYoinksFromTopic(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/get/all/yoinks/from/testtopic", nil)
 	w := httptest.NewRecorder()
 
-	setupRouter().ServeHTTP(w, req)
+	setupRouter(testServer()).ServeHTTP(w, req)
 
 	res := w.Result()
 	defer res.Body.Close()
@@ -230,7 +252,7 @@ func TestGetLatestYoinkFromTopic(t *testing.T) {
 	// publish a yoink
 	req := httptest.NewRequest(http.MethodGet, "/publish/yoink/for/testtopic?num=666.666&threads=7&result=discard", nil)
 	w := httptest.NewRecorder()
-	setupRouter().ServeHTTP(w, req)
+	setupRouter(testServer()).ServeHTTP(w, req)
 	res1 := w.Result()
 	defer res1.Body.Close()
 	data1, err := io.ReadAll(res1.Body)
@@ -243,7 +265,7 @@ func TestGetLatestYoinkFromTopic(t *testing.T) {
 	r := httptest.NewRequest(http.MethodGet, "/get/latest/yoink/from/testtopic", nil)
 	rr := httptest.NewRecorder()
 
-	setupRouter().ServeHTTP(rr, r)
+	setupRouter(testServer()).ServeHTTP(rr, r)
 
 	res2 := rr.Result()
 	defer res2.Body.Close()
@@ -266,7 +288,7 @@ func TestGetLatestYoinkFromTopic(t *testing.T) {
 		t.Fatalf("yoink mismatch, expected: %s got: %s", got1, got2)
 	}
 
-	err = os.Remove(testPath)
+	err = removeTestDB(testPath)
 	if err != nil {
 		t.Errorf("Cleaning up temporary test file failed: %v", err)
 	}
@@ -278,7 +300,7 @@ func publishYoink(topic, data string) (*Yoink, error) {
 	// publish a yoink
 	req := httptest.NewRequest(http.MethodGet, "/publish/yoink/for/"+topic+"?"+data, nil)
 	w := httptest.NewRecorder()
-	setupRouter().ServeHTTP(w, req)
+	setupRouter(testServer()).ServeHTTP(w, req)
 	res := w.Result()
 	defer res.Body.Close()
 	body, err := io.ReadAll(res.Body)
@@ -295,3 +317,199 @@ func publishYoink(topic, data string) (*Yoink, error) {
 	}
 	return y, nil
 }
+
+func TestPublishForTopicPOST(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	body := `{"gps": {"lat": 37.98, "lon": 23.72}, "readings": [1, 2, 3], "name": "device"}`
+	req := httptest.NewRequest(http.MethodPost, "/yoink/testtopic?name=home", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	setupRouter(testServer()).ServeHTTP(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, res.StatusCode)
+	}
+
+	y := &Yoink{}
+	err = json.NewDecoder(res.Body).Decode(y)
+	if err != nil {
+		t.Fatalf("decoding response failed: %v", err)
+	}
+	t.Logf("yoink response: %#v", y)
+
+	gps, ok := y.Content["gps"].(map[string]interface{})
+	if !ok || gps["lat"] != 37.98 || gps["lon"] != 23.72 {
+		t.Fatalf("nested object not stored correctly: %#v", y.Content["gps"])
+	}
+	readings, ok := y.Content["readings"].([]interface{})
+	if !ok || len(readings) != 3 {
+		t.Fatalf("array not stored correctly: %#v", y.Content["readings"])
+	}
+	if y.Content["name"] != "home" {
+		t.Fatalf("query parameter was not merged into body, got name: %v", y.Content["name"])
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+// TestPublishKeepsNumbers checks that numbers come back with the exact digits they were published with
+func TestPublishKeepsNumbers(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	body := `{"counter": 18446744073709551617, "ratio": 0.1}`
+	req := httptest.NewRequest(http.MethodPost, "/yoink/testtopic?serial=9007199254740993&big=12345678901234567890123", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, w.Code)
+	}
+
+	for _, path := range []string{"/get/latest/yoink/from/testtopic", "/yoinks/testtopic"} {
+		req = httptest.NewRequest(http.MethodGet, path, nil)
+		w = httptest.NewRecorder()
+		setupRouter(testServer()).ServeHTTP(w, req)
+		got := w.Body.String()
+		for _, want := range []string{`"serial":9007199254740993`, `"big":12345678901234567890123`, `"counter":18446744073709551617`, `"ratio":0.1`} {
+			if !strings.Contains(got, want) {
+				t.Fatalf("expected %s in the response of %s got %s", want, path, got)
+			}
+		}
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+// TestAsHTTPError checks that errors without an HTTPError become internal server errors instead of panicking handlers
+func TestAsHTTPError(t *testing.T) {
+	e := asHTTPError(fmt.Errorf("wrapped: %w", NewHTTPError("topic is empty", http.StatusBadRequest, "Bad Request")))
+	if e.Status != http.StatusBadRequest || e.Cause != "topic is empty" {
+		t.Fatalf("expected the wrapped error got %+v", e)
+	}
+	e = asHTTPError(errors.New("database is closed"))
+	if e.Status != http.StatusInternalServerError || e.Cause != "database is closed" {
+		t.Fatalf("expected an internal server error got %+v", e)
+	}
+}
+
+func TestMergeJSONObjects(t *testing.T) {
+	// Fields keep their order and numbers are copied as they were sent
+	cases := []struct{ base, overrides, merged string }{
+		{`{"z":1,"a":12345678901234567890}`, `{"tempreading":25}`, `{"z":1,"a":12345678901234567890,"tempreading":25}`},
+		{`{"z":1,"tempreading":24.50}`, `{"tempreading":25}`, `{"z":1,"tempreading":25}`},
+		{`{"gps":{"lon":23.7275388,"lat":0},"z":"\u00e9"}`, `{"gps":{"lat":37.9838096}}`, `{"gps":{"lon":23.7275388,"lat":37.9838096},"z":"\u00e9"}`},
+		{`{"tempreading":{"celsius":25},"z":true}`, `{"tempreading":25}`, `{"tempreading":25,"z":true}`},
+		{`{"z":1.0}`, `{}`, `{"z":1.0}`},
+	}
+	for _, c := range cases {
+		got, err := mergeJSONObjects([]byte(c.base), []byte(c.overrides))
+		if err != nil || string(got) != c.merged {
+			t.Errorf("expected %s for %s got %s: %v", c.merged, c.base, got, err)
+		}
+	}
+
+	// The timestamp is taken out without touching the rest of the body
+	body, timestamp, err := extractBodyTimestamp([]byte(`{"z":1,"_timestamp":"2022-10-26T11:00:00Z","a":0.10000000000000001}`))
+	if err != nil || string(body) != `{"z":1,"a":0.10000000000000001}` || string(timestamp) != `"2022-10-26T11:00:00Z"` {
+		t.Fatalf("expected the body without its timestamp got %s and %s: %v", body, timestamp, err)
+	}
+}
+
+func TestPublishForTopicPOSTErrors(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"wrong content type", "text/plain", `{"a": 1}`, http.StatusUnsupportedMediaType},
+		{"missing content type", "", `{"a": 1}`, http.StatusUnsupportedMediaType},
+		{"invalid json", "application/json", `{"a": `, http.StatusBadRequest},
+		{"array body", "application/json", `[1, 2]`, http.StatusBadRequest},
+		{"empty body", "application/json", ``, http.StatusBadRequest},
+		{"too large", "application/json", `{"a": "` + strings.Repeat("a", defaultMaxBodySize) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/yoink/testtopic", strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+
+		setupRouter(testServer()).ServeHTTP(w, req)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d got %d with body %s", tt.name, tt.status, w.Code, w.Body.String())
+		}
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+func TestPublishForTopicStructured(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	y, err := publishYoink("testtopic", "reading=1&reading=2&gps.lat=1.2&gps.lon=3.4")
+	if err != nil {
+		t.Fatalf("publish yoink failed: %v", err)
+	}
+	t.Logf("yoink response: %#v", y)
+
+	readings, ok := y.Content["reading"].([]interface{})
+	if !ok || len(readings) != 2 || readings[0] != 1.0 || readings[1] != 2.0 {
+		t.Fatalf("repeated parameter not stored as array: %#v", y.Content["reading"])
+	}
+	gps, ok := y.Content["gps"].(map[string]interface{})
+	if !ok || gps["lat"] != 1.2 || gps["lon"] != 3.4 {
+		t.Fatalf("dotted parameters not stored as object: %#v", y.Content["gps"])
+	}
+
+	// Query parameters are merged into nested objects of the body
+	req := httptest.NewRequest(http.MethodPost, "/yoink/testtopic?gps.lat=5.6", strings.NewReader(`{"gps": {"lat": 1.2, "lon": 3.4}}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+
+	merged := &Yoink{}
+	err = json.NewDecoder(w.Body).Decode(merged)
+	if err != nil {
+		t.Fatalf("decoding response failed: %v", err)
+	}
+	gps, ok = merged.Content["gps"].(map[string]interface{})
+	if !ok || gps["lat"] != 5.6 || gps["lon"] != 3.4 {
+		t.Fatalf("query parameters not merged into nested object: %#v", merged.Content["gps"])
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultMemoryMaxYoinks is how many yoinks of a topic are kept in memory when none is configured
+const defaultMemoryMaxYoinks = 10000
+
+// memoryStore keeps yoinks in memory, so they are gone when the server stops
+// Every topic keeps at most maxYoinks of its newest yoinks so memory use stays bounded
+type memoryStore struct {
+	mu        sync.RWMutex
+	topics    map[string][]*Yoink // oldest first, by timestamp and then id
+	lastID    int64
+	maxYoinks int
+}
+
+// newMemoryStore returns an empty store that keeps at most maxYoinks yoinks of every topic
+func newMemoryStore(maxYoinks int) *memoryStore {
+	return &memoryStore{topics: map[string][]*Yoink{}, maxYoinks: maxYoinks}
+}
+
+// Publish decodes every yoink before storing any of them so they are either all stored or none are
+func (m *memoryStore) Publish(_ context.Context, pending []pendingYoink) ([]*Yoink, error) {
+	receivedAt := time.Now().UTC().Truncate(time.Millisecond)
+	yoinks := make([]*Yoink, 0, len(pending))
+	for _, p := range pending {
+		// Timestamps are kept with the same precision as in the database so cursors work the same
+		y := &Yoink{Topic: p.topic, Timestamp: p.timestamp.UTC().Truncate(time.Millisecond), ReceivedAt: receivedAt}
+		if p.timestamp.IsZero() {
+			y.Timestamp = receivedAt
+		}
+		err := decodeContent(p.content, &y.Content)
+		if err != nil {
+			return nil, err
+		}
+		yoinks = append(yoinks, y)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, y := range yoinks {
+		m.lastID++
+		y.ID = m.lastID
+		m.insert(y)
+	}
+	for topic, maxYoinks := range topicCaps(pending) {
+		if n := len(m.topics[topic]) - maxYoinks; n > 0 {
+			m.dropOldest(topic, n)
+		}
+	}
+	return yoinks, nil
+}
+
+// insert puts a yoink in its place in its topic and drops the oldest yoink if the topic is over maxYoinks
+// Yoinks mostly come in order, so the search usually ends at the end
+func (m *memoryStore) insert(y *Yoink) {
+	yoinks := m.topics[y.Topic]
+	i := sort.Search(len(yoinks), func(i int) bool { return yoinks[i].Timestamp.After(y.Timestamp) })
+	yoinks = append(yoinks, nil)
+	copy(yoinks[i+1:], yoinks[i:])
+	yoinks[i] = y
+	if len(yoinks) > m.maxYoinks {
+		yoinks[0] = nil // let the dropped yoink be garbage collected
+		yoinks = yoinks[1:]
+	}
+	m.topics[y.Topic] = yoinks
+}
+
+func (m *memoryStore) Latest(_ context.Context, topic string, cond waitCondition) (*Yoink, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	yoinks := m.topics[topic]
+	for i := len(yoinks) - 1; i >= 0; i-- {
+		if cond.matches(yoinks[i]) {
+			return yoinks[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memoryStore) LastID(_ context.Context, topic string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	id := int64(0)
+	for _, y := range m.topics[topic] {
+		if y.ID > id {
+			id = y.ID
+		}
+	}
+	return id, nil
+}
+
+// LastN picks the newest yoinks in the range and only then puts them in the requested order
+func (m *memoryStore) LastN(_ context.Context, topic string, n int, tr timeRange) (YoinkIterator, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	newest := []*Yoink{}
+	yoinks := m.topics[topic]
+	for i := len(yoinks) - 1; i >= 0 && len(newest) < n; i-- {
+		if tr.includes(yoinks[i]) {
+			newest = append(newest, yoinks[i])
+		}
+	}
+	if tr.ascending {
+		reverseYoinks(newest)
+	}
+	return newYoinkSlice(newest), nil
+}
+
+func (m *memoryStore) All(ctx context.Context, topic string, tr timeRange, after *pageCursor) (YoinkIterator, error) {
+	yoinks, err := m.Range(ctx, topic, tr, after, -1)
+	if err != nil {
+		return nil, err
+	}
+	return newYoinkSlice(yoinks), nil
+}
+
+// Range returns every yoink after the cursor when limit is negative
+func (m *memoryStore) Range(_ context.Context, topic string, tr timeRange, after *pageCursor, limit int) ([]*Yoink, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	page := []*Yoink{}
+	yoinks := m.topics[topic]
+	for n := 0; n < len(yoinks) && len(page) != limit; n++ {
+		i := len(yoinks) - 1 - n
+		if tr.ascending {
+			i = n
+		}
+		if tr.includes(yoinks[i]) && (after == nil || tr.comesAfter(yoinks[i], *after)) {
+			page = append(page, yoinks[i])
+		}
+	}
+	return page, nil
+}
+
+func (m *memoryStore) After(_ context.Context, topic string, id int64) (YoinkIterator, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	yoinks := []*Yoink{}
+	for _, y := range m.topics[topic] {
+		if y.ID > id {
+			yoinks = append(yoinks, y)
+		}
+	}
+	sort.Slice(yoinks, func(i, j int) bool { return yoinks[i].ID < yoinks[j].ID })
+	return newYoinkSlice(yoinks), nil
+}
+
+func (m *memoryStore) Topics(context.Context) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	topics := make([]string, 0, len(m.topics))
+	for topic := range m.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+func (m *memoryStore) DeleteTopic(_ context.Context, topic string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted := int64(len(m.topics[topic]))
+	delete(m.topics, topic)
+	return deleted, nil
+}
+
+func (m *memoryStore) DeleteBefore(_ context.Context, topic string, cutoff time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	yoinks := m.topics[topic]
+	i := sort.Search(len(yoinks), func(i int) bool { return !yoinks[i].Timestamp.Before(cutoff) })
+	return m.dropOldest(topic, i), nil
+}
+
+func (m *memoryStore) Trim(_ context.Context, topic string, keep int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.topics[topic]) - keep
+	if n <= 0 {
+		return 0, nil
+	}
+	return m.dropOldest(topic, n), nil
+}
+
+// dropOldest deletes the n oldest yoinks of a topic, copying the rest so the memory they used can be freed
+func (m *memoryStore) dropOldest(topic string, n int) int64 {
+	if n == 0 {
+		return 0
+	}
+	yoinks := m.topics[topic]
+	if n == len(yoinks) {
+		delete(m.topics, topic)
+	} else {
+		m.topics[topic] = append([]*Yoink(nil), yoinks[n:]...)
+	}
+	return int64(n)
+}
+
+// reverseYoinks reverses the order of yoinks in place
+func reverseYoinks(yoinks []*Yoink) {
+	for i, j := 0, len(yoinks)-1; i < j; i, j = i+1, j-1 {
+		yoinks[i], yoinks[j] = yoinks[j], yoinks[i]
+	}
+}
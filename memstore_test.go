@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	checkStore(t, newMemoryStore(defaultMemoryMaxYoinks))
+}
+
+// TestMemoryStoreMaxYoinks checks that topics only keep their newest yoinks in memory
+func TestMemoryStoreMaxYoinks(t *testing.T) {
+	store := newMemoryStore(3)
+	ctx := context.Background()
+	start := time.Date(2022, 10, 26, 11, 0, 0, 0, time.UTC)
+	// The yoink at minute 1 comes in late and is dropped first since it's the oldest
+	for _, minute := range []int{0, 2, 3, 1, 4} {
+		_, err := store.Publish(ctx, []pendingYoink{
+			{topic: "testtopic", timestamp: start.Add(time.Duration(minute) * time.Minute), content: []byte(`{"minute":` + strconv.Itoa(minute) + `}`)},
+			{topic: "othertopic", content: []byte(`{}`)},
+		})
+		if err != nil {
+			t.Fatalf("publishing failed: %v", err)
+		}
+	}
+
+	yoinks, err := store.Range(ctx, "testtopic", timeRange{ascending: true}, nil, -1)
+	if err != nil || len(yoinks) != 3 {
+		t.Fatalf("expected 3 yoinks got %d", len(yoinks))
+	}
+	for i, minute := range []json.Number{"2", "3", "4"} {
+		if yoinks[i].Content["minute"] != minute {
+			t.Errorf("expected yoink %d to be from minute %v got %v", i, minute, yoinks[i].Content["minute"])
+		}
+	}
+	if len(store.topics["othertopic"]) != 3 {
+		t.Fatalf("expected 3 yoinks on othertopic got %d", len(store.topics["othertopic"]))
+	}
+
+	// Newer yoinks than the bound are found the same way as in the database
+	it, err := store.LastN(ctx, "testtopic", 2, timeRange{since: start.Add(3 * time.Minute)})
+	if err != nil {
+		t.Fatalf("reading yoinks failed: %v", err)
+	}
+	yoinks, _ = collectYoinks(it)
+	if len(yoinks) != 2 || yoinks[0].Content["minute"] != json.Number("4") || yoinks[1].Content["minute"] != json.Number("3") {
+		t.Fatalf("expected the yoinks of minutes 4 and 3 got %d yoinks", len(yoinks))
+	}
+
+	deleted, err := store.DeleteBefore(ctx, "testtopic", start.Add(4*time.Minute))
+	if err != nil || deleted != 2 {
+		t.Fatalf("expected 2 yoinks to be deleted got %d", deleted)
+	}
+}
+
+// TestSetupStorage tests the SetupStorage function
+func TestSetupStorage(t *testing.T) {
+	initialPathValue := os.Getenv("DB_PATH")
+	initialStorageValue := os.Getenv("DATAYOINKER_STORAGE")
+	defer func() {
+		resetPathEnv(initialPathValue)
+		os.Setenv("DATAYOINKER_STORAGE", initialStorageValue)
+	}()
+
+	cleanupPathEnv()
+	expected := map[string]string{"": storageSQLite, "memory": storageMemory, "bolt": storageBolt, "sqlite": storageSQLite, "redis": storageSQLite}
+	for value, storage := range expected {
+		os.Setenv("DATAYOINKER_STORAGE", value)
+		if got := SetupStorage(); got != storage {
+			t.Errorf("expected storage %s for %q got %s", storage, value, got)
+		}
+	}
+
+	os.Setenv("DATAYOINKER_STORAGE", "")
+	os.Setenv("DB_PATH", ":memory:")
+	if SetupStorage() != storageMemory {
+		t.Fatalf("expected DB_PATH=:memory: to keep yoinks in memory")
+	}
+}
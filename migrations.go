@@ -0,0 +1,276 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// migration is a change to the schema that is applied to a database once
+type migration struct {
+	description string
+	migrate     func(tx *sql.Tx) error
+}
+
+// migrations are all the changes to the schema in the order they are applied
+// The version of a database is the number of migrations applied to it, which is stored as its user_version
+// Released migrations must never be changed or removed, changes to the schema are added as new migrations at the end
+var migrations = []migration{
+	{"create the yoinks, webhooks, registered topics and alert rules tables", createInitialSchema},
+	{"move topics into their own table referenced by yoinks", createTopicsTable},
+	{"index yoinks by topic and timestamp", indexYoinksByTopic},
+	{"give registered topics an owner key", addOwnerKeys},
+	{"index webhook deliveries by webhook", indexWebhookDeliveries},
+}
+
+// migrate applies the migrations a database doesn't have yet, each in its own transaction
+func migrate(sqlite *sql.DB) error {
+	version := 0
+	err := sqlite.QueryRow(`PRAGMA user_version;`).Scan(&version)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database is at version %d but only versions up to %d are known", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		err = applyMigration(sqlite, i+1, migrations[i])
+		if err != nil {
+			return fmt.Errorf("migrating database to version %d failed: %w", i+1, err)
+		}
+		log.Printf("migrated database to version %d: %s", i+1, migrations[i].description)
+	}
+	return nil
+}
+
+// applyMigration runs a migration and sets the version of the database in the same transaction
+// If anything fails the database is left as it was
+func applyMigration(sqlite *sql.DB, version int, m migration) error {
+	tx, err := sqlite.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = m.migrate(tx)
+	if err != nil {
+		return err
+	}
+	// PRAGMA doesn't take parameters, version is always a number
+	_, err = tx.Exec(`PRAGMA user_version = ` + strconv.Itoa(version) + `;`)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// createInitialSchema creates the schema as it was before migrations existed
+// Databases created by those versions can be at any point of it, so every step only does what's missing
+// Like every migration it keeps the SQL it ran when it was released, whatever the schema looks like now
+func createInitialSchema(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE if not exists yoinks (
+		id INTEGER NOT NULL,
+		topic TEXT NOT NULL,
+		timestamp DATETIME DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+		received_at DATETIME,
+		content TEXT NOT NULL,
+		PRIMARY KEY (id AUTOINCREMENT)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Databases created before received_at existed need the column added
+	// Existing yoinks were timestamped when they were received so their timestamp is copied over
+	exists := 0
+	err = tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('yoinks') WHERE name = 'received_at';`).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		_, err = tx.Exec(`ALTER TABLE yoinks ADD COLUMN received_at DATETIME;`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE yoinks SET received_at = timestamp WHERE received_at IS NULL;`)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Databases created before millisecond precision have timestamps that sort and compare differently,
+	// like the ones from CURRENT_TIMESTAMP, so they are rewritten to a single format
+	_, err = tx.Exec(`UPDATE yoinks SET
+		timestamp = strftime('%Y-%m-%d %H:%M:%f', timestamp),
+		received_at = strftime('%Y-%m-%d %H:%M:%f', received_at)
+	WHERE timestamp != strftime('%Y-%m-%d %H:%M:%f', timestamp)
+		OR received_at != strftime('%Y-%m-%d %H:%M:%f', received_at);`)
+	if err != nil {
+		return err
+	}
+
+	// Webhooks and their delivery log live next to the yoinks
+	_, err = tx.Exec(`CREATE TABLE if not exists webhooks (
+		id INTEGER NOT NULL,
+		topic TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (id AUTOINCREMENT)
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`CREATE TABLE if not exists webhook_deliveries (
+		id INTEGER NOT NULL,
+		webhook_id INTEGER NOT NULL,
+		yoink_id INTEGER NOT NULL,
+		attempt INTEGER NOT NULL,
+		status_code INTEGER NOT NULL,
+		error TEXT NOT NULL,
+		succeeded BOOLEAN NOT NULL,
+		attempted_at DATETIME NOT NULL,
+		PRIMARY KEY (id AUTOINCREMENT)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Registered topics and the hashes of their keys
+	_, err = tx.Exec(`CREATE TABLE if not exists registered_topics (
+		topic TEXT NOT NULL,
+		key_hash TEXT NOT NULL,
+		private BOOLEAN NOT NULL DEFAULT FALSE,
+		read_key_hash TEXT NOT NULL DEFAULT '',
+		retention_ms INTEGER,
+		max_yoinks INTEGER,
+		registered_at DATETIME NOT NULL,
+		PRIMARY KEY (topic)
+	);`)
+	if err != nil {
+		return err
+	}
+	// Topics registered before these columns existed are public, use the default retention and have no cap
+	columns := []struct{ name, definition string }{
+		{"private", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"read_key_hash", "TEXT NOT NULL DEFAULT ''"},
+		{"retention_ms", "INTEGER"},
+		{"max_yoinks", "INTEGER"},
+	}
+	for _, c := range columns {
+		exists := 0
+		err = tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('registered_topics') WHERE name = ?;`, c.name).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			continue
+		}
+		_, err = tx.Exec(`ALTER TABLE registered_topics ADD COLUMN ` + c.name + ` ` + c.definition + `;`)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Alert rules keep their state in the database so it survives restarts
+	_, err = tx.Exec(`CREATE TABLE if not exists alert_rules (
+		id INTEGER NOT NULL,
+		topic TEXT NOT NULL,
+		name TEXT NOT NULL,
+		condition TEXT NOT NULL,
+		for_ms INTEGER NOT NULL,
+		stale_ms INTEGER NOT NULL,
+		webhook_url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		alert_topic TEXT NOT NULL,
+		state TEXT NOT NULL,
+		state_since DATETIME NOT NULL,
+		last_seen DATETIME NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (id AUTOINCREMENT)
+	);`)
+	return err
+}
+
+// createTopicsTable moves the names of topics into a table of their own that yoinks reference by id
+// SQLite can't change a column in place, so the yoinks table is copied into a new one with the same ids
+// Registered topics, webhooks and alert rules keep the name, they exist before anything is published to a topic
+// and outlive its yoinks, while a row of topics only exists while the SQLite store has yoinks for it
+func createTopicsTable(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE topics (
+		id INTEGER NOT NULL,
+		name TEXT NOT NULL UNIQUE,
+		PRIMARY KEY (id)
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO topics (name) SELECT DISTINCT topic FROM yoinks ORDER BY topic;`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`CREATE TABLE yoinks_by_topic_id (
+		id INTEGER NOT NULL,
+		topic_id INTEGER NOT NULL REFERENCES topics (id),
+		timestamp DATETIME DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+		received_at DATETIME,
+		content TEXT NOT NULL,
+		PRIMARY KEY (id AUTOINCREMENT)
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO yoinks_by_topic_id (id, topic_id, timestamp, received_at, content)
+		SELECT yoinks.id, topics.id, yoinks.timestamp, yoinks.received_at, yoinks.content
+		FROM yoinks JOIN topics ON topics.name = yoinks.topic;`)
+	if err != nil {
+		return err
+	}
+	// The ids of deleted yoinks must not be handed out again since clients use them as cursors
+	lastID := int64(0)
+	err = tx.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM sqlite_sequence WHERE name = 'yoinks';`).Scan(&lastID)
+	if err != nil {
+		return err
+	}
+	// Dropping the old table drops its triggers as well, the new one needs none since the stores apply the caps when publishing
+	_, err = tx.Exec(`DROP TABLE yoinks;`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`ALTER TABLE yoinks_by_topic_id RENAME TO yoinks;`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM sqlite_sequence WHERE name = 'yoinks';`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO sqlite_sequence (name, seq) VALUES ('yoinks', ?);`, lastID)
+	return err
+}
+
+// indexYoinksByTopic indexes yoinks by topic and timestamp so reading a topic doesn't scan every yoink
+// The index holds every other column that's read as well, so reading a topic is answered from the index alone
+// instead of looking up every yoink it finds in the table, at the cost of storing the content of every yoink twice
+// The id comes right after the timestamp since it would otherwise only order the yoinks after the content does
+func indexYoinksByTopic(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE INDEX yoinks_by_topic_timestamp ON yoinks (topic_id, timestamp, id, received_at, content);`)
+	return err
+}
+
+// addOwnerKeys adds the hash of the key that manages a registered topic
+// Topics registered before it existed have none, topicAccess.ownerHash decides what manages them
+func addOwnerKeys(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE registered_topics ADD COLUMN owner_key_hash TEXT NOT NULL DEFAULT '';`)
+	return err
+}
+
+// indexWebhookDeliveries indexes the delivery log by webhook so reading and trimming the log of a webhook doesn't scan all of them
+// Like every index it ends with the id, so the newest attempts of a webhook are found in order
+func indexWebhookDeliveries(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE INDEX webhook_deliveries_by_webhook ON webhook_deliveries (webhook_id);`)
+	return err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// TestMigrateTopicsTable checks that databases from before the topics table existed keep their yoinks and ids
+func TestMigrateTopicsTable(t *testing.T) {
+	initialPathValue := os.Getenv("DB_PATH")
+	testPath := "/tmp/yoinker.db"
+	os.Setenv("DB_PATH", testPath)
+
+	old, err := sql.Open("sqlite", testPath)
+	if err != nil {
+		t.Fatalf("opening database failed: %v", err)
+	}
+	tx, err := old.Begin()
+	if err != nil {
+		t.Fatalf("starting transaction failed: %v", err)
+	}
+	err = createInitialSchema(tx)
+	if err != nil {
+		t.Fatalf("creating old schema failed: %v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatalf("committing old schema failed: %v", err)
+	}
+	_, err = old.Exec(`INSERT INTO yoinks (topic, timestamp, received_at, content) VALUES
+		('testtopic', '2022-10-26 11:21:11.000', '2022-10-26 11:21:11.000', '{"a":1}'),
+		('othertopic', '2022-10-26 11:21:12.000', '2022-10-26 11:21:12.000', '{"a":2}'),
+		('testtopic', '2022-10-26 11:21:13.000', '2022-10-26 11:21:13.000', '{"a":3}'),
+		('testtopic', '2022-10-26 11:21:14.000', '2022-10-26 11:21:14.000', '{"a":4}');`)
+	if err != nil {
+		t.Fatalf("inserting old yoinks failed: %v", err)
+	}
+	// The latest yoink was deleted so its id must not come back
+	_, err = old.Exec(`DELETE FROM yoinks WHERE id = 4;`)
+	if err != nil {
+		t.Fatalf("deleting old yoink failed: %v", err)
+	}
+	old.Close()
+
+	db, err = SetupDB()
+	if err != nil {
+		t.Fatalf("setting up the database failed: %v", err)
+	}
+	version := 0
+	err = db.QueryRow(`PRAGMA user_version;`).Scan(&version)
+	if err != nil || version != len(migrations) {
+		t.Fatalf("expected version %d got %d", len(migrations), version)
+	}
+	// Caps are applied when publishing so there are no triggers, and yoinks and webhook deliveries are indexed
+	schema := map[string]string{}
+	rows, err := db.Query(`SELECT name, type FROM sqlite_master WHERE type IN ('trigger', 'index') AND name NOT LIKE 'sqlite_%';`)
+	if err != nil {
+		t.Fatalf("reading schema failed: %v", err)
+	}
+	for rows.Next() {
+		name, kind := "", ""
+		err = rows.Scan(&name, &kind)
+		if err != nil {
+			t.Fatalf("reading schema failed: %v", err)
+		}
+		schema[name] = kind
+	}
+	rows.Close()
+	if len(schema) != 2 || schema["yoinks_by_topic_timestamp"] != "index" || schema["webhook_deliveries_by_webhook"] != "index" {
+		t.Fatalf("expected only the indexes of yoinks and webhook deliveries got %v", schema)
+	}
+
+	code, yoinks := getYoinks(t, "/yoinks/testtopic?order=asc")
+	if code != http.StatusOK || len(yoinks) != 2 {
+		t.Fatalf("expected 2 yoinks got %d", len(yoinks))
+	}
+	if yoinks[0].ID != 1 || yoinks[1].ID != 3 || yoinks[1].Topic != "testtopic" || yoinks[1].Content["a"] != 3.0 {
+		t.Fatalf("expected yoinks to be kept as they were got %+v %+v", yoinks[0], yoinks[1])
+	}
+	y, err := publishYoink("testtopic", "a=5")
+	if err != nil {
+		t.Fatalf("publish yoink failed: %v", err)
+	}
+	if y.ID != 5 {
+		t.Fatalf("expected id 5 got %d", y.ID)
+	}
+
+	// Opening it again doesn't change anything
+	db.Close()
+	db, err = SetupDB()
+	if err != nil {
+		t.Fatalf("setting up the database again failed: %v", err)
+	}
+	if count := countYoinks(t, "testtopic"); count != 3 {
+		t.Fatalf("expected 3 yoinks got %d", count)
+	}
+
+	// Databases from newer versions are refused
+	_, err = db.Exec(`PRAGMA user_version = 1000;`)
+	if err != nil {
+		t.Fatalf("setting version failed: %v", err)
+	}
+	db.Close()
+	_, err = SetupDB()
+	if err == nil {
+		t.Fatalf("expected error for a database from a newer version")
+	}
+
+	err = removeTestDB(testPath)
+	if err != nil {
+		t.Errorf("cleaning up temporary test file failed: %v", err)
+	}
+	resetPathEnv(initialPathValue)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPageLimit is the number of yoinks in a page when no limit is given
+const defaultPageLimit = 100
+
+// maxPageLimit is the largest number of yoinks in a page, larger limits are lowered to it
+const maxPageLimit = 1000
+
+// timeRange restricts reads to a window of time and sets the order of the results
+type timeRange struct {
+	since     time.Time // zero means there is no lower bound
+	until     time.Time // zero means there is no upper bound
+	ascending bool
+}
+
+// parseTimeRange reads the since, until and order query parameters of a read request
+// Both bounds are inclusive and results are newest first unless order=asc is given
+func parseTimeRange(r *http.Request) (timeRange, error) {
+	tr := timeRange{}
+	queryParams := r.URL.Query()
+	now := time.Now().UTC()
+
+	if value := queryParams.Get("since"); value != "" {
+		since, err := parseTimeBound(value, now)
+		if err != nil {
+			return tr, errors.New("since: " + err.Error())
+		}
+		tr.since = since
+	}
+	if value := queryParams.Get("until"); value != "" {
+		until, err := parseTimeBound(value, now)
+		if err != nil {
+			return tr, errors.New("until: " + err.Error())
+		}
+		tr.until = until
+	}
+	if !tr.since.IsZero() && !tr.until.IsZero() && tr.since.After(tr.until) {
+		return tr, errors.New("since is after until")
+	}
+
+	switch strings.ToLower(queryParams.Get("order")) {
+	case "", "desc":
+	case "asc":
+		tr.ascending = true
+	default:
+		return tr, errors.New("order must be asc or desc")
+	}
+	return tr, nil
+}
+
+// parseTimeBound parses a bound of a time range
+// Apart from the timestamp formats publishers can use, durations like -1h are relative to now
+func parseTimeBound(value string, now time.Time) (time.Time, error) {
+	if value == "now" {
+		return now, nil
+	}
+	if !unixTimestamp.MatchString(value) {
+		if d, err := time.ParseDuration(value); err == nil {
+			return now.Add(d), nil
+		}
+	}
+	return parseTimeValue(value)
+}
+
+// where returns the conditions and arguments that limit the yoinks of a topic to the range
+func (tr timeRange) where(topic string) (string, []interface{}) {
+	conditions := []string{yoinkTopicIs}
+	args := []interface{}{topic}
+	if !tr.since.IsZero() {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, tr.since.Format(timestampLayout))
+	}
+	if !tr.until.IsZero() {
+		conditions = append(conditions, "timestamp <= ?")
+		args = append(args, tr.until.Format(timestampLayout))
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// orderBy returns the ordering of the results, tie-broken by id so it's stable
+func (tr timeRange) orderBy() string {
+	if tr.ascending {
+		return "timestamp ASC, id ASC"
+	}
+	return "timestamp DESC, id DESC"
+}
+
+// afterCursor returns the condition and arguments that skip the yoinks up to and including the cursor
+func (tr timeRange) afterCursor(c pageCursor) (string, []interface{}) {
+	comparison := "<"
+	if tr.ascending {
+		comparison = ">"
+	}
+	return "(timestamp " + comparison + " ? OR (timestamp = ? AND id " + comparison + " ?))", []interface{}{c.Timestamp, c.Timestamp, c.ID}
+}
+
+// includes reports whether a yoink is in the range, for stores that don't filter with SQL
+// Bounds are compared at the millisecond precision timestamps are stored with, like the conditions of where
+func (tr timeRange) includes(y *Yoink) bool {
+	if !tr.since.IsZero() && y.Timestamp.Before(tr.since.Truncate(time.Millisecond)) {
+		return false
+	}
+	return tr.until.IsZero() || !y.Timestamp.After(tr.until.Truncate(time.Millisecond))
+}
+
+// comesAfter reports whether a yoink comes after the cursor in the order of the range, like the condition of afterCursor
+func (tr timeRange) comesAfter(y *Yoink, c pageCursor) bool {
+	t, _ := time.Parse(timestampLayout, c.Timestamp)
+	if tr.ascending {
+		return y.Timestamp.After(t) || y.Timestamp.Equal(t) && y.ID > c.ID
+	}
+	return y.Timestamp.Before(t) || y.Timestamp.Equal(t) && y.ID < c.ID
+}
+
+// pageCursor marks the last yoink of a page so the next page can continue after it
+type pageCursor struct {
+	Timestamp string `json:"t"` // formatted with timestampLayout to compare with what's stored
+	ID        int64  `json:"id"`
+}
+
+// encodeCursor returns the opaque cursor of the page ending with the yoink
+func encodeCursor(y *Yoink) string {
+	c, _ := json.Marshal(pageCursor{
+		Timestamp: y.Timestamp.UTC().Format(timestampLayout),
+		ID:        y.ID,
+	})
+	return base64.RawURLEncoding.EncodeToString(c)
+}
+
+// decodeCursor parses an opaque cursor returned by encodeCursor
+func decodeCursor(value string) (pageCursor, error) {
+	c := pageCursor{}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return c, errors.New("cursor is malformed")
+	}
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return c, errors.New("cursor is malformed")
+	}
+	_, err = time.Parse(timestampLayout, c.Timestamp)
+	if err != nil || c.ID < 1 {
+		return c, errors.New("cursor is malformed")
+	}
+	return c, nil
+}
+
+// parsePageLimit reads the limit query parameter, defaulting to defaultPageLimit and capped at maxPageLimit
+func parsePageLimit(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return defaultPageLimit, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New("limit is not a number")
+	}
+	if limit < 1 {
+		return 0, errors.New("limit is less than 1")
+	}
+	if limit > maxPageLimit {
+		return maxPageLimit, nil
+	}
+	return limit, nil
+}
+
+// nextPageURL returns the URL of the request with the cursor and limit of the next page
+func nextPageURL(r *http.Request, cursor string, limit int) string {
+	queryParams := r.URL.Query()
+	queryParams.Set("cursor", cursor)
+	queryParams.Set("limit", strconv.Itoa(limit))
+	return r.URL.Path + "?" + queryParams.Encode()
+}
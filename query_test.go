@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseTimeBound checks absolute and relative time range bounds
+func TestParseTimeBound(t *testing.T) {
+	now := time.Date(2022, 10, 26, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"now", now},
+		{"-1h", time.Date(2022, 10, 26, 11, 0, 0, 0, time.UTC)},
+		{"-90m", time.Date(2022, 10, 26, 10, 30, 0, 0, time.UTC)},
+		{"+1h", time.Date(2022, 10, 26, 13, 0, 0, 0, time.UTC)},
+		{"2022-10-26T11:21:11Z", time.Date(2022, 10, 26, 11, 21, 11, 0, time.UTC)},
+		{"1666783271", time.Date(2022, 10, 26, 11, 21, 11, 0, time.UTC)},
+		{"0", time.Unix(0, 0).UTC()},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTimeBound(tt.value, now)
+		if err != nil {
+			t.Errorf("parseTimeBound(%q) failed: %v", tt.value, err)
+			continue
+		}
+		if !got.Equal(tt.expected) {
+			t.Errorf("parseTimeBound(%q): expected %v got %v", tt.value, tt.expected, got)
+		}
+	}
+
+	for _, value := range []string{"yesterday", "-1 hour", "2022-10-26"} {
+		_, err := parseTimeBound(value, now)
+		if err == nil {
+			t.Errorf("parseTimeBound(%q): expected error", value)
+		}
+	}
+}
+
+// getYoinks requests a list of yoinks and decodes the response
+func getYoinks(t *testing.T, path string) (int, []*Yoink) {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+
+	ys := []*Yoink{}
+	if w.Code != http.StatusOK {
+		return w.Code, ys
+	}
+	err := json.NewDecoder(w.Body).Decode(&ys)
+	if err != nil {
+		t.Fatalf("decoding response failed: %v", err)
+	}
+	return w.Code, ys
+}
+
+func TestTimeRangeQueries(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	// Publish one yoink per minute starting at 11:00
+	for _, ts := range []string{"2022-10-26T11:00:00Z", "2022-10-26T11:01:00Z", "2022-10-26T11:02:00Z", "2022-10-26T11:03:00Z"} {
+		_, err := publishYoink("testtopic", "a=1&_timestamp="+ts)
+		if err != nil {
+			t.Fatalf("publish yoink failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		path     string
+		expected []string
+	}{
+		{"/get/all/yoinks/from/testtopic?since=2022-10-26T11:01:00Z&until=2022-10-26T11:02:00Z", []string{"11:02", "11:01"}},
+		{"/yoinks/testtopic?since=2022-10-26T11:02:00Z&order=asc", []string{"11:02", "11:03"}},
+		{"/yoinks/testtopic?until=2022-10-26T11:00:30Z", []string{"11:00"}},
+		{"/get/last/2/yoinks/from/testtopic?order=asc", []string{"11:02", "11:03"}},
+		{"/yoinks/testtopic/2?until=2022-10-26T11:02:00Z", []string{"11:02", "11:01"}},
+		{"/get/2/latest/yoinks/from/testtopic?since=2022-10-26T11:00:00Z&until=2022-10-26T11:01:00Z&order=ASC", []string{"11:00", "11:01"}},
+		{"/yoinks/testtopic?since=-1h", []string{}},
+	}
+
+	for _, tt := range tests {
+		code, ys := getYoinks(t, tt.path)
+		if code != http.StatusOK {
+			t.Errorf("%s: expected status %d got %d", tt.path, http.StatusOK, code)
+			continue
+		}
+		got := []string{}
+		for _, y := range ys {
+			got = append(got, y.Timestamp.Format("15:04"))
+		}
+		if len(got) != len(tt.expected) {
+			t.Errorf("%s: expected %v got %v", tt.path, tt.expected, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.expected[i] {
+				t.Errorf("%s: expected %v got %v", tt.path, tt.expected, got)
+				break
+			}
+		}
+	}
+
+	for _, path := range []string{
+		"/yoinks/testtopic?since=yesterday",
+		"/yoinks/testtopic?order=sideways",
+		"/yoinks/testtopic/2?since=2022-10-26T12:00:00Z&until=2022-10-26T11:00:00Z",
+	} {
+		code, _ := getYoinks(t, path)
+		if code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d got %d", path, http.StatusBadRequest, code)
+		}
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+func TestGetAllYoinksFromTopicPagination(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	// Yoinks sharing a timestamp must not be skipped or repeated across pages
+	published := []int64{}
+	for _, ts := range []string{"1666783271000", "1666783271000", "1666783271000", "1666783272000", "1666783273000"} {
+		y, err := publishYoink("testtopic", "a=1&_timestamp="+ts)
+		if err != nil {
+			t.Fatalf("publish yoink failed: %v", err)
+		}
+		published = append(published, y.ID)
+	}
+
+	for _, order := range []string{"desc", "asc"} {
+		path := "/yoinks/testtopic?limit=2&order=" + order
+		seen := []int64{}
+		for pages := 0; path != ""; pages++ {
+			if pages > len(published) {
+				t.Fatalf("%s: pagination did not end", order)
+			}
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			w := httptest.NewRecorder()
+			setupRouter(testServer()).ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: expected status %d got %d with body %s", order, http.StatusOK, w.Code, w.Body.String())
+			}
+
+			ys := []*Yoink{}
+			err = json.NewDecoder(w.Body).Decode(&ys)
+			if err != nil {
+				t.Fatalf("decoding response failed: %v", err)
+			}
+			if len(ys) > 2 {
+				t.Fatalf("%s: page larger than limit: %d", order, len(ys))
+			}
+			for _, y := range ys {
+				seen = append(seen, y.ID)
+			}
+
+			path = ""
+			link := w.Header().Get("Link")
+			if link != "" {
+				if w.Header().Get("X-Next-Cursor") == "" {
+					t.Fatalf("%s: Link header without X-Next-Cursor", order)
+				}
+				path = link[1:strings.Index(link, ">")]
+			}
+		}
+
+		if len(seen) != len(published) {
+			t.Fatalf("%s: expected %d yoinks got %v", order, len(published), seen)
+		}
+		for i := range seen {
+			expected := published[len(published)-1-i]
+			if order == "asc" {
+				expected = published[i]
+			}
+			if seen[i] != expected {
+				t.Fatalf("%s: yoinks out of order: %v", order, seen)
+			}
+		}
+	}
+
+	for _, path := range []string{
+		"/yoinks/testtopic?cursor=notacursor",
+		"/yoinks/testtopic?limit=0",
+		"/yoinks/testtopic?limit=many",
+	} {
+		code, _ := getYoinks(t, path)
+		if code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d got %d", path, http.StatusBadRequest, code)
+		}
+	}
+
+	// Limits above the maximum are lowered instead of refused
+	code, ys := getYoinks(t, "/yoinks/testtopic?limit=1000000")
+	if code != http.StatusOK || len(ys) != len(published) {
+		t.Errorf("expected status %d and %d yoinks got %d and %d", http.StatusOK, len(published), code, len(ys))
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
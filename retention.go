@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// defaultRetentionInterval is how often old yoinks are deleted by default
+const defaultRetentionInterval = 10 * time.Minute
+
+// retention is how long the yoinks of topics that aren't registered are kept, 0 keeps them forever
+var retention time.Duration
+
+// registeredRetention is how long the yoinks of registered topics are kept unless they set their own, 0 keeps them forever
+var registeredRetention time.Duration
+
+// retentionInterval is how often old yoinks are deleted
+var retentionInterval = defaultRetentionInterval
+
+// deleteExpiredYoinks deletes every yoink that is older than the retention of its topic and returns how many were deleted
+func (s *server) deleteExpiredYoinks(now time.Time) (int64, error) {
+	deleted := int64(0)
+
+	// Registered topics keep their own retention, or the default of registered topics if they have none
+	rows, err := db.Query(`SELECT topic, retention_ms FROM registered_topics;`)
+	if err != nil {
+		return deleted, err
+	}
+	retentions := map[string]time.Duration{}
+	for rows.Next() {
+		topic := ""
+		retentionMs := sql.NullInt64{}
+		err = rows.Scan(&topic, &retentionMs)
+		if err != nil {
+			rows.Close()
+			return deleted, err
+		}
+		retentions[topic] = retentionFromMs(retentionMs, registeredRetention)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return deleted, err
+	}
+
+	// Every topic has its own cutoff, so they are gone through one at a time
+	topics, err := s.store.Topics(context.Background())
+	if err != nil {
+		return deleted, err
+	}
+	for _, topic := range topics {
+		keep, registered := retentions[topic]
+		if !registered {
+			keep = retention
+		}
+		if keep <= 0 {
+			continue
+		}
+		n, err := s.store.DeleteBefore(context.Background(), topic, now.Add(-keep))
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	return deleted, nil
+}
+
+// startRetention periodically deletes the yoinks that are older than the retention of their topic
+func (s *server) startRetention() {
+	go func() {
+		ticker := time.NewTicker(retentionInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			deleted, err := s.deleteExpiredYoinks(now.UTC())
+			if err != nil {
+				log.Println("failed deleting old yoinks:", err)
+			}
+			if deleted > 0 {
+				log.Printf("deleted %d old yoinks", deleted)
+			}
+		}
+	}()
+}
+
+// capCache holds the max_yoinks of the registered topics that have one so publishing doesn't look them up every time
+// It's loaded when it's first needed and reset whenever a cap might have changed
+type capCache struct {
+	mu   sync.Mutex
+	caps map[string]int
+}
+
+// yoinkCaps is the cache of the caps of the registered topics
+var yoinkCaps capCache
+
+// get returns the cap of a topic, 0 if it has none
+func (c *capCache) get(topic string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.caps == nil {
+		rows, err := db.Query(`SELECT topic, max_yoinks FROM registered_topics WHERE max_yoinks > 0;`)
+		if err != nil {
+			return 0, err
+		}
+		defer rows.Close()
+		caps := map[string]int{}
+		for rows.Next() {
+			topic, maxYoinks := "", 0
+			err = rows.Scan(&topic, &maxYoinks)
+			if err != nil {
+				return 0, err
+			}
+			caps[topic] = maxYoinks
+		}
+		if err = rows.Err(); err != nil {
+			return 0, err
+		}
+		c.caps = caps
+	}
+	return c.caps[topic], nil
+}
+
+// reset drops the cached caps so they are loaded again the next time they're needed
+func (c *capCache) reset() {
+	c.mu.Lock()
+	c.caps = nil
+	c.mu.Unlock()
+}
+
+// withCaps returns the pending yoinks with the caps of their topics so they are applied when they're stored
+func withCaps(pending []pendingYoink) ([]pendingYoink, error) {
+	capped := make([]pendingYoink, len(pending))
+	for i, p := range pending {
+		maxYoinks, err := yoinkCaps.get(p.topic)
+		if err != nil {
+			return nil, err
+		}
+		p.maxYoinks = maxYoinks
+		capped[i] = p
+	}
+	return capped, nil
+}
+
+// retentionFromMs turns a retention stored in milliseconds into a duration, falling back to the default when it's not set
+func retentionFromMs(retentionMs sql.NullInt64, fallback time.Duration) time.Duration {
+	if !retentionMs.Valid {
+		return fallback
+	}
+	return time.Duration(retentionMs.Int64) * time.Millisecond
+}
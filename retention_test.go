@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// updateTopic changes the settings of a topic through the API
+func updateTopic(t *testing.T, topic, body, key string) (int, *Topic) {
+	req := httptest.NewRequest(http.MethodPatch, "/topics/"+topic, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(topicKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	topicInfo := &Topic{}
+	err := json.NewDecoder(w.Body).Decode(topicInfo)
+	if err != nil {
+		t.Fatalf("decoding response failed: %v", err)
+	}
+	return w.Code, topicInfo
+}
+
+func TestDeleteExpiredYoinks(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+	retention = 24 * time.Hour
+	registeredRetention = 72 * time.Hour
+	defer func() {
+		retention = 0
+		registeredRetention = 0
+	}()
+
+	for _, topic := range []string{"registered", "custom", "forever"} {
+		code, topicInfo := registerTopic(t, topic, `{"key":"hunter22","owner_key":"hunter22-owner"}`, "")
+		if code != http.StatusCreated || topicInfo.Retention != "72h0m0s" {
+			t.Fatalf("expected topic %s to be registered with the default retention got status %d", topic, code)
+		}
+	}
+
+	// Only the owner of a registered topic can change its retention
+	code, _ := updateTopic(t, "custom", `{"retention":"1h"}`, "")
+	if code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d got %d", http.StatusUnauthorized, code)
+	}
+	code, _ = updateTopic(t, "custom", `{"retention":"-1h"}`, "hunter22-owner")
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected status %d got %d", http.StatusBadRequest, code)
+	}
+	code, _ = updateTopic(t, "normal", `{"retention":"1h"}`, "")
+	if code != http.StatusConflict {
+		t.Fatalf("expected status %d got %d", http.StatusConflict, code)
+	}
+	code, topicInfo := updateTopic(t, "custom", `{"retention":"1h"}`, "hunter22-owner")
+	if code != http.StatusOK || topicInfo.Retention != "1h0m0s" {
+		t.Fatalf("expected retention to be changed got status %d", code)
+	}
+	code, topicInfo = updateTopic(t, "forever", `{"retention":"0s"}`, "hunter22-owner")
+	if code != http.StatusOK || topicInfo.Retention != "0s" {
+		t.Fatalf("expected retention to be changed got status %d", code)
+	}
+	code, topicInfo = updateTopic(t, "registered", `{"retention":""}`, "hunter22-owner")
+	if code != http.StatusOK || topicInfo.Retention != "72h0m0s" {
+		t.Fatalf("expected default retention got status %d", code)
+	}
+
+	now := time.Now()
+	for _, topic := range []string{"normal", "registered", "custom", "forever"} {
+		for _, age := range []time.Duration{0, 2 * time.Hour, 48 * time.Hour, 96 * time.Hour} {
+			timestamp := strconv.FormatInt(now.Add(-age).Unix(), 10)
+			code := publishWithKey(topic, "tempreading=25&_timestamp="+timestamp, "hunter22")
+			if code != http.StatusOK {
+				t.Fatalf("expected status %d got %d", http.StatusOK, code)
+			}
+		}
+	}
+
+	deleted, err := testServer().deleteExpiredYoinks(now.UTC())
+	if err != nil {
+		t.Fatalf("deleting old yoinks failed: %v", err)
+	}
+	if deleted != 6 {
+		t.Fatalf("expected 6 yoinks to be deleted got %d", deleted)
+	}
+	expected := map[string]int{"normal": 2, "registered": 3, "custom": 1, "forever": 4}
+	for topic, count := range expected {
+		if got := countYoinks(t, topic); got != count {
+			t.Errorf("expected %d yoinks on %s got %d", count, topic, got)
+		}
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+// TestSetupRegisteredRetention checks that registered topics never keep their yoinks for less time than the ones that aren't registered
+func TestSetupRegisteredRetention(t *testing.T) {
+	initialValue := os.Getenv("DATAYOINKER_REGISTERED_RETENTION")
+	defer os.Setenv("DATAYOINKER_REGISTERED_RETENTION", initialValue)
+
+	tests := []struct {
+		value        string
+		unregistered time.Duration
+		expected     time.Duration
+	}{
+		{"", 0, 0},
+		{"", 24 * time.Hour, 0},
+		{"invalid", 24 * time.Hour, 0},
+		{"-1h", 0, 0},
+		{"72h", 24 * time.Hour, 72 * time.Hour},
+		{"1h", 24 * time.Hour, 24 * time.Hour},
+		{"72h", 0, 0},
+	}
+	for _, tt := range tests {
+		os.Setenv("DATAYOINKER_REGISTERED_RETENTION", tt.value)
+		if got := SetupRegisteredRetention(tt.unregistered); got != tt.expected {
+			t.Errorf("SetupRegisteredRetention(%s) with %q: expected %s got %s", tt.unregistered, tt.value, tt.expected, got)
+		}
+	}
+}
+
+func TestDeleteExpiredYoinksInBatches(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+	retention = time.Hour
+	defer func() { retention = 0 }()
+
+	old := time.Now().Add(-2 * time.Hour).UTC().Format(timestampLayout)
+	publishYoink("testtopic", "tempreading=25")
+	_, err = db.Exec(
+		`WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < ?)
+		INSERT INTO yoinks (topic_id, timestamp, received_at, content) SELECT (SELECT id FROM topics WHERE name = 'testtopic'), ?, ?, '{}' FROM n;`,
+		2*deleteBatchSize+1, old, old,
+	)
+	if err != nil {
+		t.Fatalf("inserting yoinks failed: %v", err)
+	}
+
+	deleted, err := testServer().deleteExpiredYoinks(time.Now().UTC())
+	if err != nil {
+		t.Fatalf("deleting old yoinks failed: %v", err)
+	}
+	if deleted != 2*deleteBatchSize+1 || countYoinks(t, "testtopic") != 1 {
+		t.Fatalf("expected %d yoinks to be deleted got %d", 2*deleteBatchSize+1, deleted)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+func TestYoinkCap(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	code, _ := registerTopic(t, "testtopic", `{"key":"hunter22","owner_key":"hunter22-owner"}`, "")
+	if code != http.StatusCreated {
+		t.Fatalf("expected topic to be registered got status %d", code)
+	}
+	for i := 1; i <= 5; i++ {
+		publishWithKey("testtopic", "tempreading="+strconv.Itoa(i), "hunter22")
+	}
+
+	code, _ = updateTopic(t, "testtopic", `{"max_yoinks":-1}`, "hunter22-owner")
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected status %d got %d", http.StatusBadRequest, code)
+	}
+	// Setting the cap deletes the oldest yoinks right away
+	code, topicInfo := updateTopic(t, "testtopic", `{"max_yoinks":3}`, "hunter22-owner")
+	if code != http.StatusOK || topicInfo.MaxYoinks != 3 {
+		t.Fatalf("expected cap to be set got status %d", code)
+	}
+	if count := countYoinks(t, "testtopic"); count != 3 {
+		t.Fatalf("expected 3 yoinks got %d", count)
+	}
+
+	// Publishing keeps only the latest ones, including in batches
+	publishWithKey("testtopic", "tempreading=6", "hunter22")
+	batch := `[{"topic":"testtopic","content":{"tempreading":7}},{"topic":"testtopic","content":{"tempreading":8}}]`
+	req := httptest.NewRequest(http.MethodPost, "/yoinks", strings.NewReader(batch))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(topicKeyHeader, "hunter22")
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, w.Code)
+	}
+	_, yoinks := getYoinks(t, "/yoinks/testtopic?order=asc")
+	if len(yoinks) != 3 || yoinks[0].Content["tempreading"] != 6.0 || yoinks[2].Content["tempreading"] != 8.0 {
+		t.Fatalf("expected the latest 3 yoinks got %d", len(yoinks))
+	}
+
+	// Other topics aren't capped
+	for i := 0; i < 5; i++ {
+		publishYoink("othertopic", "tempreading=25")
+	}
+	if count := countYoinks(t, "othertopic"); count != 5 {
+		t.Fatalf("expected 5 yoinks got %d", count)
+	}
+
+	// A cap of 0 removes it
+	code, topicInfo = updateTopic(t, "testtopic", `{"max_yoinks":0}`, "hunter22-owner")
+	if code != http.StatusOK || topicInfo.MaxYoinks != 0 {
+		t.Fatalf("expected cap to be removed got status %d", code)
+	}
+	publishWithKey("testtopic", "tempreading=9", "hunter22")
+	if count := countYoinks(t, "testtopic"); count != 4 {
+		t.Fatalf("expected 4 yoinks got %d", count)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// yoinkColumns are the columns that make up a Yoink in the order they are scanned, with the name of its topic looked up
+const yoinkColumns = `id, (SELECT name FROM topics WHERE topics.id = yoinks.topic_id) AS topic, timestamp, received_at, content`
+
+// yoinkTopicIs is the condition that limits yoinks to the topic with the name given as an argument
+const yoinkTopicIs = `topic_id = (SELECT id FROM topics WHERE name = ?)`
+
+// deleteBatchSize is the most yoinks deleted in one statement
+// Every statement holds the write lock of the database, so it's kept short to not block publishing
+const deleteBatchSize = 500
+
+// deleteBatchPause is how long to wait between batches of deletes so writers waiting for the lock get a turn
+var deleteBatchPause = 10 * time.Millisecond
+
+// sqliteStore keeps yoinks in the yoinks table of a SQLite database
+// Reads go through their own pool so they don't take connections that writers are waiting for
+type sqliteStore struct {
+	db     *sql.DB
+	readDB *sql.DB
+}
+
+// newSQLiteStore returns a store using a database that SetupDB has prepared, reading from readDB
+// readDB can be the same database when there's no separate pool for reads
+func newSQLiteStore(db, readDB *sql.DB) *sqliteStore {
+	return &sqliteStore{db: db, readDB: readDB}
+}
+
+// Publish inserts the yoinks and deletes the ones over the caps of their topics in a single transaction
+// so the yoinks over a cap are never seen
+func (s *sqliteStore) Publish(ctx context.Context, pending []pendingYoink) ([]*Yoink, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	yoinks := make([]*Yoink, 0, len(pending))
+	for _, p := range pending {
+		y, err := insertYoink(tx, p.topic, p.content, p.timestamp)
+		if err != nil {
+			return nil, err
+		}
+		yoinks = append(yoinks, y)
+	}
+	for topic, maxYoinks := range topicCaps(pending) {
+		_, err = tx.Exec(
+			`DELETE FROM yoinks WHERE id IN (
+				SELECT id FROM yoinks WHERE `+yoinkTopicIs+` ORDER BY timestamp DESC, id DESC LIMIT -1 OFFSET ?
+			);`,
+			topic,
+			maxYoinks,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return yoinks, nil
+}
+
+func (s *sqliteStore) Latest(ctx context.Context, topic string, cond waitCondition) (*Yoink, error) {
+	after := ""
+	if !cond.after.IsZero() {
+		after = cond.after.Format(timestampLayout)
+	}
+	rows, err := s.readDB.QueryContext(
+		ctx,
+		`SELECT `+yoinkColumns+` FROM yoinks WHERE `+yoinkTopicIs+` AND id > ? AND timestamp > ? ORDER BY timestamp DESC, id DESC LIMIT 1;`,
+		topic,
+		cond.afterID,
+		after,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanYoink(rows)
+}
+
+func (s *sqliteStore) LastID(ctx context.Context, topic string) (int64, error) {
+	id := int64(0)
+	err := s.readDB.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM yoinks WHERE `+yoinkTopicIs+`;`, topic).Scan(&id)
+	return id, err
+}
+
+// LastN picks the newest rows in the range and only then puts them in the requested order
+func (s *sqliteStore) LastN(ctx context.Context, topic string, n int, tr timeRange) (YoinkIterator, error) {
+	where, args := tr.where(topic)
+	return s.query(
+		ctx,
+		`SELECT id, topic, timestamp, received_at, content FROM (
+			SELECT `+yoinkColumns+` FROM yoinks WHERE `+where+` ORDER BY timestamp DESC, id DESC LIMIT ?
+		) ORDER BY `+tr.orderBy()+`;`,
+		append(args, n)...,
+	)
+}
+
+func (s *sqliteStore) All(ctx context.Context, topic string, tr timeRange, after *pageCursor) (YoinkIterator, error) {
+	where, args := tr.where(topic)
+	if after != nil {
+		cursorWhere, cursorArgs := tr.afterCursor(*after)
+		where += " AND " + cursorWhere
+		args = append(args, cursorArgs...)
+	}
+	return s.query(ctx, `SELECT `+yoinkColumns+` FROM yoinks WHERE `+where+` ORDER BY `+tr.orderBy()+`;`, args...)
+}
+
+func (s *sqliteStore) Range(ctx context.Context, topic string, tr timeRange, after *pageCursor, limit int) ([]*Yoink, error) {
+	where, args := tr.where(topic)
+	if after != nil {
+		cursorWhere, cursorArgs := tr.afterCursor(*after)
+		where += " AND " + cursorWhere
+		args = append(args, cursorArgs...)
+	}
+	it, err := s.query(ctx, `SELECT `+yoinkColumns+` FROM yoinks WHERE `+where+` ORDER BY `+tr.orderBy()+` LIMIT ?;`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	return collectYoinks(it)
+}
+
+func (s *sqliteStore) After(ctx context.Context, topic string, id int64) (YoinkIterator, error) {
+	return s.query(ctx, `SELECT `+yoinkColumns+` FROM yoinks WHERE `+yoinkTopicIs+` AND id > ? ORDER BY id ASC;`, topic, id)
+}
+
+func (s *sqliteStore) Topics(ctx context.Context) ([]string, error) {
+	rows, err := s.readDB.QueryContext(ctx, `SELECT name FROM topics ORDER BY name;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	topics := []string{}
+	for rows.Next() {
+		topic := ""
+		err = rows.Scan(&topic)
+		if err != nil {
+			return nil, err
+		}
+		topics = append(topics, topic)
+	}
+	return topics, rows.Err()
+}
+
+func (s *sqliteStore) DeleteTopic(ctx context.Context, topic string) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM yoinks WHERE `+yoinkTopicIs+`;`, topic)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`DELETE FROM topics WHERE name = ?;`, topic)
+	if err != nil {
+		return 0, err
+	}
+	return deleted, tx.Commit()
+}
+
+// DeleteBefore deletes in batches of deleteBatchSize until there is nothing left to delete
+func (s *sqliteStore) DeleteBefore(ctx context.Context, topic string, cutoff time.Time) (int64, error) {
+	return s.deleteInBatches(
+		ctx,
+		`DELETE FROM yoinks WHERE id IN (
+			SELECT id FROM yoinks WHERE `+yoinkTopicIs+` AND timestamp < ? LIMIT ?
+		);`,
+		topic,
+		cutoff.UTC().Format(timestampLayout),
+		deleteBatchSize,
+	)
+}
+
+// Trim deletes in batches as well since lowering the cap of a large topic can delete a lot of yoinks
+func (s *sqliteStore) Trim(ctx context.Context, topic string, keep int) (int64, error) {
+	return s.deleteInBatches(
+		ctx,
+		`DELETE FROM yoinks WHERE id IN (
+			SELECT id FROM yoinks WHERE `+yoinkTopicIs+` ORDER BY timestamp DESC, id DESC LIMIT ? OFFSET ?
+		);`,
+		topic,
+		deleteBatchSize,
+		keep,
+	)
+}
+
+// deleteInBatches runs a delete statement that deletes at most deleteBatchSize yoinks until it comes up short
+func (s *sqliteStore) deleteInBatches(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	deleted := int64(0)
+	for {
+		res, err := s.db.ExecContext(ctx, query, args...)
+		if err != nil {
+			return deleted, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+		if n < deleteBatchSize {
+			return deleted, nil
+		}
+		time.Sleep(deleteBatchPause)
+	}
+}
+
+// query runs a query returning yoinkColumns and returns an iterator over its rows
+func (s *sqliteStore) query(ctx context.Context, query string, args ...interface{}) (YoinkIterator, error) {
+	rows, err := s.readDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return sqliteRows{rows}, nil
+}
+
+// sqliteRows is an iterator over the yoinks returned by a query
+type sqliteRows struct {
+	*sql.Rows
+}
+
+func (r sqliteRows) Yoink() (*Yoink, error) {
+	return scanYoink(r.Rows)
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx so inserts can happen inside a transaction or not
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// insertYoink stores the content for a topic and returns the yoink as it was saved
+// A zero timestamp means the yoink is timestamped with the time it was received
+func insertYoink(q queryRower, topic string, content []byte, timestamp time.Time) (*Yoink, error) {
+	receivedAt := time.Now().UTC()
+	if timestamp.IsZero() {
+		timestamp = receivedAt
+	}
+
+	// Topics are created the first time something is published to them
+	// Updating the name to itself when it already exists makes RETURNING work either way
+	topicID := int64(0)
+	err := q.QueryRow(
+		`INSERT INTO topics (name) VALUES (?) ON CONFLICT (name) DO UPDATE SET name = excluded.name RETURNING id;`,
+		topic,
+	).Scan(&topicID)
+	if err != nil {
+		return nil, fmt.Errorf("inserting topic failed: %w", err)
+	}
+
+	y := &Yoink{Topic: topic} // Struct to be filled in by database results
+	tempJSON := ""            // JSON is stored as text in sqlite and can't be directly mapped to a map[string]interface{}
+	err = q.QueryRow(
+		// Return all fields to be extra sure that what we send to the client is what was saved
+		`INSERT INTO yoinks (topic_id, timestamp, received_at, content) VALUES (?, ?, ?, ?) RETURNING id, timestamp, received_at, content;`,
+		topicID,
+		timestamp.UTC().Format(timestampLayout),
+		receivedAt.Format(timestampLayout),
+		string(content),
+	).Scan(
+		&y.ID,
+		timeScanner{&y.Timestamp},
+		timeScanner{&y.ReceivedAt},
+		&tempJSON,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("inserting yoink failed: %w", err)
+	}
+	err = decodeContent([]byte(tempJSON), &y.Content)
+	if err != nil {
+		return nil, fmt.Errorf("decoding content from JSON failed: %w", err)
+	}
+	return y, nil
+}
+
+// rowScanner is the part of *sql.Rows needed to scan a yoink
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanYoink maps the current row of a query returning yoinkColumns to a yoink
+func scanYoink(rows rowScanner) (*Yoink, error) {
+	y := &Yoink{}  // Struct to be filled in by database results
+	tempJSON := "" // JSON is stored as text in sqlite and can't be directly mapped to a map[string]interface{}
+	err := rows.Scan(
+		&y.ID,
+		&y.Topic,
+		timeScanner{&y.Timestamp},
+		timeScanner{&y.ReceivedAt},
+		&tempJSON,
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = decodeContent([]byte(tempJSON), &y.Content)
+	if err != nil {
+		return nil, err
+	}
+	return y, nil
+}
+
+// defaultSQLitePragmas are run on every connection to the database before the configured ones
+// WAL lets reads go on while a yoink is being written, and the busy timeout makes writers wait for each other instead of failing
+// SQLite only enforces foreign keys on connections that turn them on, so yoinks can't point at a topic that doesn't exist
+var defaultSQLitePragmas = []string{"journal_mode=WAL", "busy_timeout=5000", "foreign_keys=ON"}
+
+// sqlitePragma matches a pragma that can be configured, a name that is optionally set to a value
+var sqlitePragma = regexp.MustCompile(`^[A-Za-z_]+(=-?[A-Za-z0-9_]+)?$`)
+
+// pragmaConnector opens connections to a SQLite database and runs pragmas on each of them
+// Pragmas like busy_timeout only apply to the connection they are run on, so running them once isn't enough
+type pragmaConnector struct {
+	driver  driver.Driver
+	dsn     string
+	pragmas []string
+}
+
+func (c pragmaConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, pragma := range c.pragmas {
+		err = execPragma(conn, pragma)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("running pragma %s failed: %w", pragma, err)
+		}
+	}
+	return conn, nil
+}
+
+func (c pragmaConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// execPragma runs a pragma on a connection, ignoring what it returns
+func execPragma(conn driver.Conn, pragma string) error {
+	stmt, err := conn.Prepare(`PRAGMA ` + pragma + `;`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(nil)
+	return err
+}
+
+// openSQLite opens a SQLite database whose connections all run the pragmas when they are opened
+func openSQLite(dsn string, pragmas []string) (*sql.DB, error) {
+	// Opening doesn't connect, it's only needed to get the driver
+	base, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	sqliteDriver := base.Driver()
+	base.Close()
+	return sql.OpenDB(pragmaConnector{driver: sqliteDriver, dsn: dsn, pragmas: pragmas}), nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Storage engines that yoinks can be kept in
+const (
+	storageSQLite = "sqlite"
+	storageMemory = "memory"
+	storageBolt   = "bolt"
+)
+
+// Store is where yoinks are kept
+// Handlers only go through it so the storage engine can be swapped without touching them
+// Registered topics, webhooks and alert rules aren't yoinks and stay in the database
+type Store interface {
+	// Publish stores yoinks and returns them as they were stored, in the same order
+	// Either every yoink is stored or none of them are, and topics are kept under the cap of their yoinks at the same time
+	Publish(ctx context.Context, pending []pendingYoink) ([]*Yoink, error)
+
+	// Latest returns the newest yoink of a topic that matches the condition, or nil if there's none
+	// The zero condition matches every yoink
+	Latest(ctx context.Context, topic string, cond waitCondition) (*Yoink, error)
+
+	// LastID returns the largest id of the yoinks of a topic, 0 if it has none
+	LastID(ctx context.Context, topic string) (int64, error)
+
+	// LastN returns the newest n yoinks of a topic in the time range, in the order of the range
+	LastN(ctx context.Context, topic string, n int, tr timeRange) (YoinkIterator, error)
+
+	// All returns every yoink of a topic in the time range that comes after the cursor, nil meaning from the start
+	All(ctx context.Context, topic string, tr timeRange, after *pageCursor) (YoinkIterator, error)
+
+	// Range returns a page of at most limit yoinks of a topic in the time range that comes after the cursor
+	Range(ctx context.Context, topic string, tr timeRange, after *pageCursor, limit int) ([]*Yoink, error)
+
+	// After returns the yoinks of a topic with an id larger than id, in the order they were stored
+	After(ctx context.Context, topic string, id int64) (YoinkIterator, error)
+
+	// Topics returns the names of the topics that have been published to
+	Topics(ctx context.Context) ([]string, error)
+
+	// DeleteTopic deletes a topic along with all of its yoinks and returns how many yoinks were deleted
+	DeleteTopic(ctx context.Context, topic string) (int64, error)
+
+	// DeleteBefore deletes the yoinks of a topic timestamped before the cutoff and returns how many were deleted
+	DeleteBefore(ctx context.Context, topic string, cutoff time.Time) (int64, error)
+
+	// Trim deletes all but the newest keep yoinks of a topic and returns how many were deleted
+	Trim(ctx context.Context, topic string, keep int) (int64, error)
+}
+
+// YoinkIterator goes through the yoinks returned by a Store one at a time
+// It's used like *sql.Rows so yoinks can be streamed without holding all of them in memory
+type YoinkIterator interface {
+	Next() bool
+	Yoink() (*Yoink, error)
+	Err() error
+	Close() error
+}
+
+// pendingYoink is a yoink that is ready to be stored
+type pendingYoink struct {
+	topic     string
+	timestamp time.Time // zero means the time it's stored
+	content   []byte
+	maxYoinks int  // how many of the newest yoinks of the topic are kept once it's stored, 0 keeps all of them
+	fromAlert bool // written by an alert rule, so it isn't evaluated against alert rules itself
+}
+
+// topicCaps returns the caps of the topics of pending yoinks, leaving out the ones without a cap
+func topicCaps(pending []pendingYoink) map[string]int {
+	caps := map[string]int{}
+	for _, p := range pending {
+		if p.maxYoinks > 0 {
+			caps[p.topic] = p.maxYoinks
+		}
+	}
+	return caps
+}
+
+// collectYoinks reads every yoink of an iterator and closes it
+func collectYoinks(it YoinkIterator) ([]*Yoink, error) {
+	defer it.Close()
+	yoinks := []*Yoink{}
+	for it.Next() {
+		y, err := it.Yoink()
+		if err != nil {
+			return nil, err
+		}
+		yoinks = append(yoinks, y)
+	}
+	return yoinks, it.Err()
+}
+
+// yoinkSlice is an iterator over yoinks that are already in memory
+type yoinkSlice struct {
+	yoinks []*Yoink
+	next   int
+}
+
+// newYoinkSlice returns an iterator over the yoinks
+func newYoinkSlice(yoinks []*Yoink) *yoinkSlice {
+	return &yoinkSlice{yoinks: yoinks}
+}
+
+func (s *yoinkSlice) Next() bool {
+	if s.next >= len(s.yoinks) {
+		return false
+	}
+	s.next++
+	return true
+}
+
+func (s *yoinkSlice) Yoink() (*Yoink, error) {
+	return s.yoinks[s.next-1], nil
+}
+
+func (s *yoinkSlice) Err() error {
+	return nil
+}
+
+func (s *yoinkSlice) Close() error {
+	return nil
+}
+
+// decodeContent decodes the stored content of a yoink
+// Numbers are kept as json.Number so they're returned exactly as they were stored instead of going through a float
+func decodeContent(data []byte, content *map[string]interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(content)
+}
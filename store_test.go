@@ -0,0 +1,639 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStore keeps yoinks in a slice so handlers can be tested without the yoinks table
+type fakeStore struct {
+	mu     sync.Mutex
+	yoinks []*Yoink
+	lastID int64
+}
+
+func (f *fakeStore) Publish(_ context.Context, pending []pendingYoink) ([]*Yoink, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	yoinks := []*Yoink{}
+	for _, p := range pending {
+		receivedAt := time.Now().UTC().Truncate(time.Millisecond)
+		timestamp := p.timestamp.UTC().Truncate(time.Millisecond)
+		if p.timestamp.IsZero() {
+			timestamp = receivedAt
+		}
+		f.lastID++
+		y := &Yoink{ID: f.lastID, Topic: p.topic, Timestamp: timestamp, ReceivedAt: receivedAt}
+		err := decodeContent(p.content, &y.Content)
+		if err != nil {
+			return nil, err
+		}
+		yoinks = append(yoinks, y)
+	}
+	f.yoinks = append(f.yoinks, yoinks...)
+	for topic, maxYoinks := range topicCaps(pending) {
+		f.trim(topic, maxYoinks)
+	}
+	return yoinks, nil
+}
+
+// matching returns the yoinks of a topic for which keep is true, newest first
+func (f *fakeStore) matching(topic string, keep func(y *Yoink) bool) []*Yoink {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	yoinks := []*Yoink{}
+	for _, y := range f.yoinks {
+		if y.Topic == topic && keep(y) {
+			yoinks = append(yoinks, y)
+		}
+	}
+	sort.Slice(yoinks, func(i, j int) bool {
+		if yoinks[i].Timestamp.Equal(yoinks[j].Timestamp) {
+			return yoinks[i].ID > yoinks[j].ID
+		}
+		return yoinks[i].Timestamp.After(yoinks[j].Timestamp)
+	})
+	return yoinks
+}
+
+// inRange reports whether a yoink is in the time range and comes after the cursor
+func inRange(y *Yoink, tr timeRange, after *pageCursor) bool {
+	if !tr.since.IsZero() && y.Timestamp.Before(tr.since) || !tr.until.IsZero() && y.Timestamp.After(tr.until) {
+		return false
+	}
+	if after == nil {
+		return true
+	}
+	cursor := &Yoink{ID: after.ID}
+	cursor.Timestamp, _ = time.Parse(timestampLayout, after.Timestamp)
+	if tr.ascending {
+		return y.Timestamp.After(cursor.Timestamp) || y.Timestamp.Equal(cursor.Timestamp) && y.ID > cursor.ID
+	}
+	return y.Timestamp.Before(cursor.Timestamp) || y.Timestamp.Equal(cursor.Timestamp) && y.ID < cursor.ID
+}
+
+// ordered puts yoinks that are newest first in the order of the range
+func ordered(yoinks []*Yoink, tr timeRange) []*Yoink {
+	if tr.ascending {
+		for i, j := 0, len(yoinks)-1; i < j; i, j = i+1, j-1 {
+			yoinks[i], yoinks[j] = yoinks[j], yoinks[i]
+		}
+	}
+	return yoinks
+}
+
+func (f *fakeStore) Latest(_ context.Context, topic string, cond waitCondition) (*Yoink, error) {
+	yoinks := f.matching(topic, cond.matches)
+	if len(yoinks) == 0 {
+		return nil, nil
+	}
+	return yoinks[0], nil
+}
+
+func (f *fakeStore) LastID(_ context.Context, topic string) (int64, error) {
+	id := int64(0)
+	for _, y := range f.matching(topic, func(*Yoink) bool { return true }) {
+		if y.ID > id {
+			id = y.ID
+		}
+	}
+	return id, nil
+}
+
+func (f *fakeStore) LastN(_ context.Context, topic string, n int, tr timeRange) (YoinkIterator, error) {
+	yoinks := f.matching(topic, func(y *Yoink) bool { return inRange(y, tr, nil) })
+	if len(yoinks) > n {
+		yoinks = yoinks[:n]
+	}
+	return newYoinkSlice(ordered(yoinks, tr)), nil
+}
+
+func (f *fakeStore) All(ctx context.Context, topic string, tr timeRange, after *pageCursor) (YoinkIterator, error) {
+	yoinks, err := f.Range(ctx, topic, tr, after, -1)
+	return newYoinkSlice(yoinks), err
+}
+
+func (f *fakeStore) Range(_ context.Context, topic string, tr timeRange, after *pageCursor, limit int) ([]*Yoink, error) {
+	yoinks := ordered(f.matching(topic, func(y *Yoink) bool { return inRange(y, tr, after) }), tr)
+	if limit >= 0 && len(yoinks) > limit {
+		yoinks = yoinks[:limit]
+	}
+	return yoinks, nil
+}
+
+func (f *fakeStore) After(_ context.Context, topic string, id int64) (YoinkIterator, error) {
+	yoinks := f.matching(topic, func(y *Yoink) bool { return y.ID > id })
+	sort.Slice(yoinks, func(i, j int) bool { return yoinks[i].ID < yoinks[j].ID })
+	return newYoinkSlice(yoinks), nil
+}
+
+func (f *fakeStore) Topics(context.Context) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seen := map[string]bool{}
+	topics := []string{}
+	for _, y := range f.yoinks {
+		if !seen[y.Topic] {
+			seen[y.Topic] = true
+			topics = append(topics, y.Topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// remove deletes the yoinks for which drop is true and returns how many were deleted
+func (f *fakeStore) remove(drop func(y *Yoink) bool) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	kept := []*Yoink{}
+	for _, y := range f.yoinks {
+		if !drop(y) {
+			kept = append(kept, y)
+		}
+	}
+	deleted := int64(len(f.yoinks) - len(kept))
+	f.yoinks = kept
+	return deleted
+}
+
+func (f *fakeStore) DeleteTopic(_ context.Context, topic string) (int64, error) {
+	return f.remove(func(y *Yoink) bool { return y.Topic == topic }), nil
+}
+
+func (f *fakeStore) DeleteBefore(_ context.Context, topic string, cutoff time.Time) (int64, error) {
+	return f.remove(func(y *Yoink) bool { return y.Topic == topic && y.Timestamp.Before(cutoff) }), nil
+}
+
+func (f *fakeStore) Trim(_ context.Context, topic string, keep int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.trim(topic, keep), nil
+}
+
+// trim deletes all but the newest keep yoinks of a topic, the lock has to be held
+func (f *fakeStore) trim(topic string, keep int) int64 {
+	yoinks := []*Yoink{}
+	for _, y := range f.yoinks {
+		if y.Topic == topic {
+			yoinks = append(yoinks, y)
+		}
+	}
+	if len(yoinks) <= keep {
+		return 0
+	}
+	sort.Slice(yoinks, func(i, j int) bool {
+		if yoinks[i].Timestamp.Equal(yoinks[j].Timestamp) {
+			return yoinks[i].ID > yoinks[j].ID
+		}
+		return yoinks[i].Timestamp.After(yoinks[j].Timestamp)
+	})
+	dropped := map[*Yoink]bool{}
+	for _, y := range yoinks[keep:] {
+		dropped[y] = true
+	}
+	kept := []*Yoink{}
+	for _, y := range f.yoinks {
+		if !dropped[y] {
+			kept = append(kept, y)
+		}
+	}
+	f.yoinks = kept
+	return int64(len(dropped))
+}
+
+// TestHandlersWithFakeStore checks that the handlers only reach yoinks through the Store of the server
+func TestHandlersWithFakeStore(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+	store := &fakeStore{}
+	router := setupRouter(newServer(store))
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(topicKeyHeader, "hunter22")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, timestamp := range []string{"11:00:00", "11:02:00", "11:01:00"} {
+		w := serve(http.MethodPost, "/yoink/testtopic", `{"_timestamp":"2022-10-26T`+timestamp+`Z","tempreading":25}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d got %d with body %s", http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+	w := serve(http.MethodPost, "/yoinks", `[{"topic":"othertopic","content":{"tempreading":26}}]`)
+	if w.Code != http.StatusOK || len(store.yoinks) != 4 {
+		t.Fatalf("expected 4 yoinks in the store got %d", len(store.yoinks))
+	}
+	if count := countYoinks(t, "testtopic"); count != 0 {
+		t.Fatalf("expected no yoinks in the database got %d", count)
+	}
+
+	// The latest yoink is the newest by timestamp, not the last one published
+	w = serve(http.MethodGet, "/yoink/testtopic", "")
+	y := &Yoink{}
+	err = json.NewDecoder(w.Body).Decode(y)
+	if err != nil || y.ID != 2 {
+		t.Fatalf("expected yoink 2 got %+v", y)
+	}
+
+	yoinks := []*Yoink{}
+	w = serve(http.MethodGet, "/yoinks/testtopic/2?order=asc", "")
+	err = json.NewDecoder(w.Body).Decode(&yoinks)
+	if err != nil || len(yoinks) != 2 || yoinks[0].ID != 3 || yoinks[1].ID != 2 {
+		t.Fatalf("expected yoinks 3 and 2 got %d yoinks", len(yoinks))
+	}
+
+	// Pages continue after the cursor of the previous one
+	w = serve(http.MethodGet, "/yoinks/testtopic?limit=2", "")
+	next := w.Header().Get("X-Next-Cursor")
+	if next == "" {
+		t.Fatalf("expected a next page")
+	}
+	w = serve(http.MethodGet, "/yoinks/testtopic?limit=2&cursor="+next, "")
+	err = json.NewDecoder(w.Body).Decode(&yoinks)
+	if err != nil || len(yoinks) != 1 || yoinks[0].ID != 1 || w.Header().Get("X-Next-Cursor") != "" {
+		t.Fatalf("expected only yoink 1 on the last page got %d yoinks", len(yoinks))
+	}
+
+	// Only registered topics can have their yoinks deleted
+	w = serve(http.MethodDelete, "/yoinks/testtopic", "")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected status %d got %d", http.StatusConflict, w.Code)
+	}
+	// The key sent with every request manages the topic from here on
+	code, _ := registerTopic(t, "testtopic", `{"key":"hunter23","owner_key":"hunter22"}`, "")
+	if code != http.StatusCreated {
+		t.Fatalf("expected topic to be registered got status %d", code)
+	}
+	w = serve(http.MethodDelete, "/yoinks/testtopic", "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d got %d", http.StatusNoContent, w.Code)
+	}
+	if len(store.yoinks) != 1 || store.yoinks[0].Topic != "othertopic" {
+		t.Fatalf("expected only the yoink of othertopic to be left got %d", len(store.yoinks))
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+// TestHandlersWithMemoryStore checks that everything works without a file when yoinks are kept in memory
+func TestHandlersWithMemoryStore(t *testing.T) {
+	initialPathValue := os.Getenv("DB_PATH")
+	os.Setenv("DB_PATH", ":memory:")
+	defer resetPathEnv(initialPathValue)
+	memdb, err := SetupDB()
+	if err != nil {
+		t.Fatalf("setting up the database failed: %v", err)
+	}
+	db = memdb
+	defer db.Close()
+	for _, path := range []string{":memory:", "yoink.db"} {
+		if _, err := os.Stat(path); err == nil {
+			t.Fatalf("expected %s not to be created", path)
+		}
+	}
+
+	store := newMemoryStore(defaultMemoryMaxYoinks)
+	router := setupRouter(newServer(store))
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(topicKeyHeader, "hunter22")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, timestamp := range []string{"11:00:00", "11:02:00", "11:01:00"} {
+		w := serve(http.MethodPost, "/yoink/testtopic", `{"_timestamp":"2022-10-26T`+timestamp+`Z","tempreading":25}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d got %d with body %s", http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+	w := serve(http.MethodPost, "/yoinks", `[{"topic":"othertopic","content":{"tempreading":26}}]`)
+	if w.Code != http.StatusOK || len(store.topics["testtopic"]) != 3 || len(store.topics["othertopic"]) != 1 {
+		t.Fatalf("expected 4 yoinks in the store got status %d", w.Code)
+	}
+	if count := countYoinks(t, "testtopic"); count != 0 {
+		t.Fatalf("expected no yoinks in the database got %d", count)
+	}
+
+	// The latest yoink is the newest by timestamp, not the last one published
+	w = serve(http.MethodGet, "/yoink/testtopic", "")
+	y := &Yoink{}
+	err = json.NewDecoder(w.Body).Decode(y)
+	if err != nil || y.ID != 2 {
+		t.Fatalf("expected yoink 2 got %+v", y)
+	}
+
+	yoinks := []*Yoink{}
+	w = serve(http.MethodGet, "/yoinks/testtopic/2?order=asc", "")
+	err = json.NewDecoder(w.Body).Decode(&yoinks)
+	if err != nil || len(yoinks) != 2 || yoinks[0].ID != 3 || yoinks[1].ID != 2 {
+		t.Fatalf("expected yoinks 3 and 2 got %d yoinks", len(yoinks))
+	}
+
+	// Pages continue after the cursor of the previous one
+	w = serve(http.MethodGet, "/yoinks/testtopic?limit=2", "")
+	next := w.Header().Get("X-Next-Cursor")
+	if next == "" {
+		t.Fatalf("expected a next page")
+	}
+	w = serve(http.MethodGet, "/yoinks/testtopic?limit=2&cursor="+next, "")
+	err = json.NewDecoder(w.Body).Decode(&yoinks)
+	if err != nil || len(yoinks) != 1 || yoinks[0].ID != 1 || w.Header().Get("X-Next-Cursor") != "" {
+		t.Fatalf("expected only yoink 1 on the last page got %d yoinks", len(yoinks))
+	}
+
+	// Only registered topics can have their yoinks deleted
+	w = serve(http.MethodDelete, "/yoinks/testtopic", "")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected status %d got %d", http.StatusConflict, w.Code)
+	}
+	// The key sent with every request manages the topic from here on
+	code, _ := registerTopic(t, "testtopic", `{"key":"hunter23","owner_key":"hunter22"}`, "")
+	if code != http.StatusCreated {
+		t.Fatalf("expected topic to be registered got status %d", code)
+	}
+	w = serve(http.MethodDelete, "/yoinks/testtopic", "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d got %d", http.StatusNoContent, w.Code)
+	}
+	if topics, _ := store.Topics(context.Background()); len(topics) != 1 || topics[0] != "othertopic" {
+		t.Fatalf("expected only othertopic to be left got %v", topics)
+	}
+}
+
+// checkStore checks that a store behaves like every other store, whatever engine it uses
+func checkStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	start := time.Date(2022, 10, 26, 11, 0, 0, 0, time.UTC)
+	minutes := func(yoinks []*Yoink) []string {
+		got := []string{}
+		for _, y := range yoinks {
+			got = append(got, strconv.Itoa(y.Timestamp.Minute()))
+		}
+		return got
+	}
+	expectMinutes := func(what string, yoinks []*Yoink, expected ...string) {
+		t.Helper()
+		got := minutes(yoinks)
+		if len(got) != len(expected) {
+			t.Fatalf("%s: expected minutes %v got %v", what, expected, got)
+		}
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Fatalf("%s: expected minutes %v got %v", what, expected, got)
+			}
+		}
+	}
+
+	// Yoinks don't have to come in order, and ids keep going up across topics
+	pending := []pendingYoink{}
+	for _, minute := range []int{0, 2, 1, 4, 3} {
+		pending = append(pending, pendingYoink{
+			topic:     "testtopic",
+			timestamp: start.Add(time.Duration(minute) * time.Minute),
+			content:   []byte(`{"minute":` + strconv.Itoa(minute) + `}`),
+		})
+	}
+	pending = append(pending, pendingYoink{topic: "othertopic", content: []byte(`{"gps":{"lat":1.2}}`)})
+	yoinks, err := store.Publish(ctx, pending)
+	if err != nil || len(yoinks) != 6 {
+		t.Fatalf("publishing failed: %v", err)
+	}
+	for i, y := range yoinks {
+		if i > 0 && y.ID <= yoinks[i-1].ID {
+			t.Fatalf("expected ids to go up got %d after %d", y.ID, yoinks[i-1].ID)
+		}
+	}
+	if yoinks[1].Content["minute"] != json.Number("2") || yoinks[5].Timestamp.IsZero() || yoinks[5].ReceivedAt.IsZero() {
+		t.Fatalf("expected yoinks as they were stored got %+v and %+v", yoinks[1], yoinks[5])
+	}
+
+	// The latest yoink is the newest by timestamp, not the last one published
+	y, err := store.Latest(ctx, "testtopic", waitCondition{})
+	if err != nil || y == nil || y.Content["minute"] != json.Number("4") {
+		t.Fatalf("expected the yoink of minute 4 got %+v", y)
+	}
+	y, err = store.Latest(ctx, "testtopic", waitCondition{afterID: yoinks[3].ID})
+	if err != nil || y == nil || y.Content["minute"] != json.Number("3") {
+		t.Fatalf("expected the yoink of minute 3 got %+v", y)
+	}
+	y, err = store.Latest(ctx, "testtopic", waitCondition{after: start.Add(4 * time.Minute)})
+	if err != nil || y != nil {
+		t.Fatalf("expected no yoink got %+v", y)
+	}
+	y, err = store.Latest(ctx, "missingtopic", waitCondition{})
+	if err != nil || y != nil {
+		t.Fatalf("expected no yoink got %+v", y)
+	}
+
+	id, err := store.LastID(ctx, "testtopic")
+	if err != nil || id != yoinks[4].ID {
+		t.Fatalf("expected last id %d got %d", yoinks[4].ID, id)
+	}
+
+	it, err := store.LastN(ctx, "testtopic", 3, timeRange{until: start.Add(3 * time.Minute), ascending: true})
+	if err != nil {
+		t.Fatalf("reading last yoinks failed: %v", err)
+	}
+	got, _ := collectYoinks(it)
+	expectMinutes("last 3 until minute 3", got, "1", "2", "3")
+
+	it, err = store.All(ctx, "testtopic", timeRange{since: start.Add(time.Minute)}, nil)
+	if err != nil {
+		t.Fatalf("reading all yoinks failed: %v", err)
+	}
+	got, _ = collectYoinks(it)
+	expectMinutes("all since minute 1", got, "4", "3", "2", "1")
+
+	// Pages continue after the cursor in both orders
+	for _, tr := range []timeRange{{}, {ascending: true}} {
+		all := []*Yoink{}
+		var after *pageCursor
+		for {
+			page, err := store.Range(ctx, "testtopic", tr, after, 2)
+			if err != nil {
+				t.Fatalf("reading a page failed: %v", err)
+			}
+			all = append(all, page...)
+			if len(page) < 2 {
+				break
+			}
+			c, _ := decodeCursor(encodeCursor(page[len(page)-1]))
+			after = &c
+		}
+		if tr.ascending {
+			expectMinutes("ascending pages", all, "0", "1", "2", "3", "4")
+		} else {
+			expectMinutes("descending pages", all, "4", "3", "2", "1", "0")
+		}
+	}
+
+	it, err = store.After(ctx, "testtopic", yoinks[1].ID)
+	if err != nil {
+		t.Fatalf("reading yoinks after an id failed: %v", err)
+	}
+	got, _ = collectYoinks(it)
+	expectMinutes("after the yoink of minute 2", got, "1", "4", "3")
+
+	topics, err := store.Topics(ctx)
+	if err != nil || len(topics) != 2 || topics[0] != "othertopic" || topics[1] != "testtopic" {
+		t.Fatalf("expected othertopic and testtopic got %v", topics)
+	}
+
+	deleted, err := store.DeleteBefore(ctx, "testtopic", start.Add(time.Minute))
+	if err != nil || deleted != 1 {
+		t.Fatalf("expected 1 yoink to be deleted got %d", deleted)
+	}
+	deleted, err = store.Trim(ctx, "testtopic", 2)
+	if err != nil || deleted != 2 {
+		t.Fatalf("expected 2 yoinks to be deleted got %d", deleted)
+	}
+	got, _ = store.Range(ctx, "testtopic", timeRange{}, nil, 10)
+	expectMinutes("after trimming", got, "4", "3")
+
+	// The cap of a topic is applied in the same go as publishing
+	_, err = store.Publish(ctx, []pendingYoink{{topic: "testtopic", timestamp: start.Add(5 * time.Minute), content: []byte(`{"minute":5}`), maxYoinks: 2}})
+	if err != nil {
+		t.Fatalf("publishing with a cap failed: %v", err)
+	}
+	got, _ = store.Range(ctx, "testtopic", timeRange{}, nil, 10)
+	expectMinutes("after publishing with a cap", got, "5", "4")
+
+	deleted, err = store.DeleteTopic(ctx, "testtopic")
+	if err != nil || deleted != 2 {
+		t.Fatalf("expected 2 yoinks to be deleted got %d", deleted)
+	}
+	topics, _ = store.Topics(ctx)
+	if len(topics) != 1 || topics[0] != "othertopic" {
+		t.Fatalf("expected only othertopic to be left got %v", topics)
+	}
+
+	// Ids aren't handed out again after deleting
+	yoinks, err = store.Publish(ctx, []pendingYoink{{topic: "testtopic", content: []byte(`{}`)}})
+	if err != nil || yoinks[0].ID <= id {
+		t.Fatalf("expected a new id got %d", yoinks[0].ID)
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	checkStore(t, newSQLiteStore(db, db))
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+func TestSetupSQLitePragmas(t *testing.T) {
+	initialPragmasValue := os.Getenv("DATAYOINKER_SQLITE_PRAGMAS")
+	defer os.Setenv("DATAYOINKER_SQLITE_PRAGMAS", initialPragmasValue)
+
+	expected := map[string]string{
+		"":                                      "journal_mode=WAL,busy_timeout=5000,foreign_keys=ON",
+		"synchronous=NORMAL":                    "journal_mode=WAL,busy_timeout=5000,foreign_keys=ON,synchronous=NORMAL",
+		"synchronous=NORMAL, cache_size=-64000": "journal_mode=WAL,busy_timeout=5000,foreign_keys=ON,synchronous=NORMAL,cache_size=-64000",
+		"optimize":                              "journal_mode=WAL,busy_timeout=5000,foreign_keys=ON,optimize",
+	}
+	for value, pragmas := range expected {
+		os.Setenv("DATAYOINKER_SQLITE_PRAGMAS", value)
+		got, err := SetupSQLitePragmas()
+		if err != nil || strings.Join(got, ",") != pragmas {
+			t.Errorf("expected pragmas %s for %q got %v: %v", pragmas, value, got, err)
+		}
+	}
+
+	// Anything that isn't a pragma fails instead of being left out
+	for _, value := range []string{"synchronous=NORMAL,user_version=1; DROP TABLE yoinks", "table_info(yoinks)", "synchronous=NORMAL,"} {
+		os.Setenv("DATAYOINKER_SQLITE_PRAGMAS", value)
+		if _, err := SetupSQLitePragmas(); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}
+
+func TestSQLiteReadDB(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	mode := ""
+	err = db.QueryRow(`PRAGMA journal_mode;`).Scan(&mode)
+	if err != nil || mode != "wal" {
+		t.Fatalf("expected journal mode wal got %s: %v", mode, err)
+	}
+	_, err = db.Exec(`INSERT INTO yoinks (topic_id, content) VALUES (-1, '{}');`)
+	if err == nil {
+		t.Fatalf("expected a yoink of a topic that doesn't exist to be refused")
+	}
+
+	readDB, err := SetupReadDB()
+	if err != nil {
+		t.Fatalf("setting up the database for reading failed: %v", err)
+	}
+	defer readDB.Close()
+	store := newSQLiteStore(db, readDB)
+	_, err = store.Publish(context.Background(), []pendingYoink{{topic: "testtopic", content: []byte(`{"a":1}`)}})
+	if err != nil {
+		t.Fatalf("publishing failed: %v", err)
+	}
+	y, err := store.Latest(context.Background(), "testtopic", waitCondition{})
+	if err != nil || y == nil || y.Content["a"] != json.Number("1") {
+		t.Fatalf("expected the published yoink to be read got %+v: %v", y, err)
+	}
+	_, err = readDB.Exec(`INSERT INTO topics (name) VALUES ('othertopic');`)
+	if err == nil {
+		t.Fatalf("expected writing through the database for reading to fail")
+	}
+
+	// Reading a topic in order is answered from the index alone instead of scanning and sorting every yoink
+	rows, err := db.Query(`EXPLAIN QUERY PLAN SELECT `+yoinkColumns+` FROM yoinks WHERE `+yoinkTopicIs+` ORDER BY timestamp DESC, id DESC LIMIT 1;`, "testtopic")
+	if err != nil {
+		t.Fatalf("explaining query failed: %v", err)
+	}
+	plan := []string{}
+	for rows.Next() {
+		var id, parent, notused int
+		detail := ""
+		err = rows.Scan(&id, &parent, &notused, &detail)
+		if err != nil {
+			t.Fatalf("reading query plan failed: %v", err)
+		}
+		plan = append(plan, detail)
+	}
+	rows.Close()
+	joined := strings.Join(plan, "\n")
+	if !strings.Contains(joined, "COVERING INDEX yoinks_by_topic_timestamp") || strings.Contains(joined, "TEMP B-TREE") {
+		t.Fatalf("expected the query to use the covering index without sorting got:\n%s", joined)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamFlushEvery is how many yoinks are written between flushes of a streamed response
+const streamFlushEvery = 100
+
+// defaultWriteTimeout is how long the server has to write a response when none is configured
+const defaultWriteTimeout = 20 * time.Second
+
+// writeTimeout is how long the server has to write a response
+// Streamed responses push the deadline back every time they flush so they can last longer
+var writeTimeout = defaultWriteTimeout
+
+// connContextKey is the context key under which the connection of a request is saved
+type connContextKey struct{}
+
+// saveConn keeps the connection in the context of its requests so handlers can change its deadlines
+// It's meant to be used as the ConnContext of the http.Server
+func saveConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// extendWriteDeadline gives the response to the request d more time to be written
+// It does nothing if the connection wasn't saved with saveConn, like in tests
+func extendWriteDeadline(r *http.Request, d time.Duration) {
+	c, ok := r.Context().Value(connContextKey{}).(net.Conn)
+	if !ok {
+		return
+	}
+	err := c.SetWriteDeadline(time.Now().Add(d))
+	if err != nil {
+		log.Println("extending write deadline failed:", err)
+	}
+}
+
+// parseStreamFormat finds out if the yoinks should be streamed instead of paginated and in which format
+// stream=true streams a JSON array while format=ndjson or an Accept header of application/x-ndjson
+// streams newline-delimited JSON
+func parseStreamFormat(r *http.Request) (stream bool, ndjson bool, err error) {
+	queryParams := r.URL.Query()
+	if value := queryParams.Get("stream"); value != "" {
+		stream, err = strconv.ParseBool(value)
+		if err != nil {
+			return false, false, errors.New("stream is not a boolean")
+		}
+	}
+
+	switch queryParams.Get("format") {
+	case "":
+	case "json":
+		return stream, false, nil
+	case "ndjson":
+		return true, true, nil
+	default:
+		return false, false, errors.New("format must be json or ndjson")
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && (mediaType == "application/x-ndjson" || mediaType == "application/ndjson") {
+			return true, true, nil
+		}
+	}
+	return stream, false, nil
+}
+
+// streamYoinks writes yoinks to the client as they are read from the store
+// Since the status has already been sent, errors along the way can only cut the response short
+func streamYoinks(w http.ResponseWriter, r *http.Request, it YoinkIterator, ndjson bool) {
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		extendWriteDeadline(r, writeTimeout)
+	}
+
+	// Encode adds a newline after every yoink which is also valid inside a JSON array
+	encoder := json.NewEncoder(w)
+	if !ndjson {
+		_, err := w.Write([]byte("["))
+		if err != nil {
+			return
+		}
+	}
+	for n := 0; it.Next(); n++ {
+		y, err := it.Yoink()
+		if err != nil {
+			log.Println("streaming yoinks failed:", err)
+			return
+		}
+		if !ndjson && n > 0 {
+			_, err = w.Write([]byte(","))
+			if err != nil {
+				return
+			}
+		}
+		err = encoder.Encode(y)
+		if err != nil {
+			return
+		}
+		if n%streamFlushEvery == 0 {
+			flush()
+		}
+	}
+	if err := it.Err(); err != nil {
+		log.Println("streaming yoinks failed:", err)
+		return
+	}
+	if !ndjson {
+		_, err := w.Write([]byte("]\n"))
+		if err != nil {
+			return
+		}
+	}
+	flush()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// publishMany publishes count yoinks to a topic in a single batch
+func publishMany(t *testing.T, topic string, count int) {
+	items := []string{}
+	for i := 0; i < count; i++ {
+		items = append(items, `{"content": {"n": `+strconv.Itoa(i)+`}}`)
+	}
+	w := publishBatch("/yoinks/"+topic, "application/json", "["+strings.Join(items, ",")+"]")
+	if w.Code != http.StatusOK {
+		t.Fatalf("publishing %d yoinks failed with status %d: %s", count, w.Code, w.Body.String())
+	}
+}
+
+func TestStreamYoinks(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	// More yoinks than fit in a page
+	count := defaultPageLimit*2 + 50
+	publishMany(t, "testtopic", count)
+
+	// JSON array
+	req := httptest.NewRequest(http.MethodGet, "/yoinks/testtopic?stream=true&order=asc", nil)
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !w.Flushed {
+		t.Fatalf("expected flushed status %d got %d", http.StatusOK, w.Code)
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("wrong content type %s", w.Header().Get("Content-Type"))
+	}
+	ys := []*Yoink{}
+	err = json.NewDecoder(w.Body).Decode(&ys)
+	if err != nil {
+		t.Fatalf("decoding streamed array failed: %v", err)
+	}
+	if len(ys) != count || ys[0].Content["n"] != 0.0 || ys[count-1].Content["n"] != float64(count-1) {
+		t.Fatalf("expected %d yoinks in order got %d", count, len(ys))
+	}
+
+	// NDJSON requested with the Accept header
+	req = httptest.NewRequest(http.MethodGet, "/get/all/yoinks/from/testtopic", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	w = httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	if w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("wrong content type %s", w.Header().Get("Content-Type"))
+	}
+	lines := 0
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		y := &Yoink{}
+		err = json.Unmarshal(scanner.Bytes(), y)
+		if err != nil {
+			t.Fatalf("decoding line %d failed: %v", lines, err)
+		}
+		lines++
+	}
+	if lines != count {
+		t.Fatalf("expected %d lines got %d", count, lines)
+	}
+
+	// Last N as NDJSON
+	req = httptest.NewRequest(http.MethodGet, "/yoinks/testtopic/3?format=ndjson", nil)
+	w = httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	if got := strings.Count(w.Body.String(), "\n"); got != 3 {
+		t.Fatalf("expected 3 lines got %d", got)
+	}
+
+	// An empty stream is still a valid array
+	req = httptest.NewRequest(http.MethodGet, "/yoinks/emptytopic?stream=1", nil)
+	w = httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	if strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Fatalf("expected empty array got %s", w.Body.String())
+	}
+
+	code, _ := getYoinks(t, "/yoinks/testtopic?format=xml")
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for unknown format got %d", http.StatusBadRequest, code)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+// TestExtendWriteDeadline checks that a response can outlive the write timeout by extending it
+func TestExtendWriteDeadline(t *testing.T) {
+	timeout := 200 * time.Millisecond
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 4; i++ {
+			extendWriteDeadline(r, timeout)
+			time.Sleep(timeout / 2)
+			w.Write([]byte(strconv.Itoa(i)))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	srv.Config.WriteTimeout = timeout
+	srv.Config.ConnContext = saveConn
+	srv.Start()
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading response body failed: %v", err)
+	}
+	if string(body) != "0123" {
+		t.Fatalf("response was cut short: %q", body)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timestampLayout is how timestamps are stored in the database, matching sqlite's strftime('%Y-%m-%d %H:%M:%f')
+const timestampLayout = "2006-01-02 15:04:05.000"
+
+// dbTimestampLayouts are the layouts a timestamp read from the database as text may have
+var dbTimestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	time.RFC3339Nano,
+}
+
+// timestampParam is the reserved query parameter and body field used to supply a timestamp
+const timestampParam = reservedParamPrefix + "timestamp"
+
+// timestampHeader is the header used to supply a timestamp
+const timestampHeader = "X-Yoink-Timestamp"
+
+// maxTimestampSkew is how far in the future a supplied timestamp can be to allow for clock drift
+const maxTimestampSkew = 5 * time.Minute
+
+// unixMillisThreshold separates Unix timestamps in seconds from ones in milliseconds
+// In seconds it's the year 5138 and in milliseconds it's early 1973, so neither is a realistic reading
+const unixMillisThreshold = 100000000000
+
+// unixTimestamp matches Unix timestamps with an optional fractional part
+var unixTimestamp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// timeScanner reads a timestamp from the database into a time.Time
+// Depending on how it was written, the driver hands timestamps over as either time.Time or text
+type timeScanner struct {
+	t *time.Time
+}
+
+// Scan implements sql.Scanner
+func (s timeScanner) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case time.Time:
+		*s.t = v.UTC()
+		return nil
+	case string:
+		return s.parse(v)
+	case []byte:
+		return s.parse(string(v))
+	}
+	return fmt.Errorf("unsupported timestamp type %T", src)
+}
+
+// parse tries every layout timestamps may be stored with
+func (s timeScanner) parse(value string) error {
+	for _, layout := range dbTimestampLayouts {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			*s.t = t.UTC()
+			return nil
+		}
+	}
+	return errors.New("unsupported timestamp format " + value)
+}
+
+// parseTimestamp parses and validates a timestamp supplied by a publisher
+// RFC3339 strings and Unix timestamps in seconds (optionally fractional) or milliseconds are accepted
+func parseTimestamp(value string) (time.Time, error) {
+	t, err := parseTimeValue(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if t.Before(time.Unix(0, 0)) {
+		return time.Time{}, errors.New("timestamp " + value + " is before the Unix epoch")
+	}
+	if t.After(time.Now().Add(maxTimestampSkew)) {
+		return time.Time{}, errors.New("timestamp " + value + " is in the future")
+	}
+	return t, nil
+}
+
+// parseTimeValue parses an RFC3339 string or a Unix timestamp in seconds (optionally fractional) or milliseconds
+func parseTimeValue(value string) (time.Time, error) {
+	if !unixTimestamp.MatchString(value) {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, errors.New("timestamp " + value + " is neither RFC3339 nor a Unix timestamp")
+		}
+		return t.UTC(), nil
+	}
+
+	intPart, fracPart, hasFrac := strings.Cut(value, ".")
+	n, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("timestamp " + value + " is out of range")
+	}
+	switch {
+	case hasFrac:
+		// Parse the fraction as nanoseconds to avoid floating point rounding
+		fracPart = (fracPart + "000000000")[:9]
+		nsec, _ := strconv.ParseInt(fracPart, 10, 64)
+		return time.Unix(n, nsec).UTC(), nil
+	case n >= unixMillisThreshold:
+		return time.Unix(n/1000, (n%1000)*int64(time.Millisecond)).UTC(), nil
+	default:
+		return time.Unix(n, 0).UTC(), nil
+	}
+}
+
+// parseTimestampJSON parses a timestamp given as a JSON string or number
+func parseTimestampJSON(raw json.RawMessage) (time.Time, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '"' {
+		value := ""
+		err := json.Unmarshal(raw, &value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return parseTimestamp(value)
+	}
+	return parseTimestamp(string(raw))
+}
+
+// requestTimestamp finds the timestamp supplied by the publisher of a request
+// The reserved query parameter takes precedence over the header which takes precedence over the body field
+// A zero time is returned if no timestamp was supplied
+func requestTimestamp(r *http.Request, bodyTimestamp json.RawMessage) (time.Time, error) {
+	if value := r.URL.Query().Get(timestampParam); value != "" {
+		return parseTimestamp(value)
+	}
+	if value := r.Header.Get(timestampHeader); value != "" {
+		return parseTimestamp(value)
+	}
+	if len(bodyTimestamp) > 0 {
+		return parseTimestampJSON(bodyTimestamp)
+	}
+	return time.Time{}, nil
+}
+
+// extractBodyTimestamp removes the reserved timestamp field from a JSON object
+// The body is returned untouched if it has no such field, and otherwise only loses that field
+func extractBodyTimestamp(body []byte) ([]byte, json.RawMessage, error) {
+	fields, err := splitJSONObject(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	i := lastJSONField(fields, timestampParam)
+	if i < 0 {
+		return body, nil, nil
+	}
+	timestamp := fields[i].value
+	kept := []jsonField{}
+	for _, f := range fields {
+		if f.name != timestampParam {
+			kept = append(kept, f)
+		}
+	}
+	return joinJSONObject(kept), timestamp, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseTimestamp checks the accepted timestamp formats
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"2022-10-26T11:21:11Z", time.Date(2022, 10, 26, 11, 21, 11, 0, time.UTC)},
+		{"2022-10-26T14:21:11+03:00", time.Date(2022, 10, 26, 11, 21, 11, 0, time.UTC)},
+		{"2022-10-26T11:21:11.25Z", time.Date(2022, 10, 26, 11, 21, 11, 250000000, time.UTC)},
+		{"1666783271", time.Date(2022, 10, 26, 11, 21, 11, 0, time.UTC)},
+		{"1666783271.5", time.Date(2022, 10, 26, 11, 21, 11, 500000000, time.UTC)},
+		{"1666783271250", time.Date(2022, 10, 26, 11, 21, 11, 250000000, time.UTC)},
+		{"0", time.Unix(0, 0).UTC()},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTimestamp(tt.value)
+		if err != nil {
+			t.Errorf("parseTimestamp(%q) failed: %v", tt.value, err)
+			continue
+		}
+		if !got.Equal(tt.expected) {
+			t.Errorf("parseTimestamp(%q): expected %v got %v", tt.value, tt.expected, got)
+		}
+	}
+
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	invalid := []string{"", "yesterday", "2022-10-26", "-5", "1969-12-31T23:59:59Z", future, "99999999999999999999"}
+	for _, value := range invalid {
+		_, err := parseTimestamp(value)
+		if err == nil {
+			t.Errorf("parseTimestamp(%q): expected error", value)
+		}
+	}
+}
+
+func TestPublishForTopicTimestamp(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		body   string
+	}{
+		{"query parameter", http.MethodGet, "/publish/yoink/for/testtopic?a=1&_timestamp=2022-10-26T11:21:11Z", "", ""},
+		{"header", http.MethodGet, "/publish/yoink/for/testtopic?a=1", "1666783271", ""},
+		{"body field", http.MethodPost, "/yoink/testtopic", "", `{"a": 1, "_timestamp": 1666783271000}`},
+		{"query over header", http.MethodGet, "/publish/yoink/for/testtopic?a=1&_timestamp=1666783271", "yesterday", ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if tt.header != "" {
+			req.Header.Set(timestampHeader, tt.header)
+		}
+		w := httptest.NewRecorder()
+		setupRouter(testServer()).ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status %d got %d with body %s", tt.name, http.StatusOK, w.Code, w.Body.String())
+			continue
+		}
+
+		y := &Yoink{}
+		err = json.NewDecoder(w.Body).Decode(y)
+		if err != nil {
+			t.Fatalf("%s: decoding response failed: %v", tt.name, err)
+		}
+		if !y.Timestamp.Equal(time.Date(2022, 10, 26, 11, 21, 11, 0, time.UTC)) {
+			t.Errorf("%s: supplied timestamp not stored, got %s", tt.name, y.Timestamp)
+		}
+		if y.ReceivedAt.IsZero() || y.ReceivedAt.Equal(y.Timestamp) {
+			t.Errorf("%s: receive time not stored separately, got %s", tt.name, y.ReceivedAt)
+		}
+		if _, ok := y.Content[timestampParam]; ok || y.Content["a"] != 1.0 {
+			t.Errorf("%s: timestamp leaked into content: %#v", tt.name, y.Content)
+		}
+	}
+
+	// Invalid timestamps are refused
+	req := httptest.NewRequest(http.MethodGet, "/publish/yoink/for/testtopic?a=1&_timestamp=yesterday", nil)
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for invalid timestamp got %d", http.StatusBadRequest, w.Code)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+// TestSetupDBAddsReceivedAt checks that databases from before received_at and millisecond precision existed are upgraded
+func TestSetupDBAddsReceivedAt(t *testing.T) {
+	initialPathValue := os.Getenv("DB_PATH")
+	testPath := "/tmp/yoinker.db"
+	os.Setenv("DB_PATH", testPath)
+
+	old, err := sql.Open("sqlite", testPath)
+	if err != nil {
+		t.Fatalf("opening database failed: %v", err)
+	}
+	_, err = old.Exec(`CREATE TABLE yoinks (
+		id INTEGER NOT NULL,
+		topic TEXT NOT NULL,
+		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+		content TEXT NOT NULL,
+		PRIMARY KEY (id AUTOINCREMENT)
+	);`)
+	if err != nil {
+		t.Fatalf("creating old schema failed: %v", err)
+	}
+	_, err = old.Exec(`INSERT INTO yoinks (topic, timestamp, content) VALUES ('testtopic', '2022-10-26 11:21:11', '{}');`)
+	if err != nil {
+		t.Fatalf("inserting old yoink failed: %v", err)
+	}
+	old.Close()
+
+	db, err = SetupDB()
+	if err != nil {
+		t.Fatalf("setting up the database failed: %v", err)
+	}
+
+	receivedAt := time.Time{}
+	err = db.QueryRow(`SELECT received_at FROM yoinks WHERE `+yoinkTopicIs+`;`, "testtopic").Scan(timeScanner{&receivedAt})
+	if err != nil {
+		t.Fatalf("reading received_at failed: %v", err)
+	}
+	if !receivedAt.Equal(time.Date(2022, 10, 26, 11, 21, 11, 0, time.UTC)) {
+		t.Fatalf("received_at was not backfilled, got %s", receivedAt)
+	}
+
+	// Old timestamps are rewritten with millisecond precision
+	stored := ""
+	err = db.QueryRow(`SELECT CAST(timestamp AS TEXT) FROM yoinks WHERE `+yoinkTopicIs+`;`, "testtopic").Scan(&stored)
+	if err != nil {
+		t.Fatalf("reading timestamp failed: %v", err)
+	}
+	if stored != "2022-10-26 11:21:11.000" {
+		t.Fatalf("timestamp was not normalized, got %s", stored)
+	}
+
+	err = removeTestDB(testPath)
+	if err != nil {
+		t.Errorf("cleaning up temporary test file failed: %v", err)
+	}
+	resetPathEnv(initialPathValue)
+}
+
+// TestYoinkOrdering checks that yoinks published within the same second come back newest first
+func TestYoinkOrdering(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	// Yoinks with identical timestamps are ordered by id
+	published := []*Yoink{}
+	for i := 0; i < 3; i++ {
+		y, err := publishYoink("testtopic", "n="+strconv.Itoa(i)+"&_timestamp=1666783271250")
+		if err != nil {
+			t.Fatalf("publish yoink failed: %v", err)
+		}
+		published = append(published, y)
+	}
+	if !published[0].Timestamp.Equal(time.Date(2022, 10, 26, 11, 21, 11, 250000000, time.UTC)) {
+		t.Fatalf("millisecond precision was lost, got %s", published[0].Timestamp)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/get/latest/yoink/from/testtopic", nil)
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	latest := &Yoink{}
+	err = json.NewDecoder(w.Body).Decode(latest)
+	if err != nil {
+		t.Fatalf("decoding response failed: %v", err)
+	}
+	if latest.ID != published[2].ID {
+		t.Fatalf("expected latest yoink %d got %d", published[2].ID, latest.ID)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/get/all/yoinks/from/testtopic", nil)
+	w = httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	ys := []*Yoink{}
+	err = json.NewDecoder(w.Body).Decode(&ys)
+	if err != nil {
+		t.Fatalf("decoding response failed: %v", err)
+	}
+	for i, y := range ys {
+		if y.ID != published[len(published)-1-i].ID {
+			t.Fatalf("yoinks out of order: %v", ys)
+		}
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// topicKeyHeader is the header that holds the key of a registered topic
+const topicKeyHeader = "X-Yoink-Key"
+
+// topicKeyParam is the query parameter that holds the key of a registered topic
+// It's never stored as part of the content so keys don't end up readable by anyone
+const topicKeyParam = "key"
+
+// minTopicKeyLength is the shortest key a topic can be registered with
+const minTopicKeyLength = 8
+
+// keyHashIterations is how many PBKDF2 iterations keys are hashed with
+// It's kept low enough that checking the key on every publish stays cheap
+const keyHashIterations = 10000
+
+// keyHashPrefix identifies how a key was hashed so the scheme can change later
+const keyHashPrefix = "pbkdf2-sha256"
+
+// Topic is the metadata of a topic
+type Topic struct {
+	Name         string     `json:"topic"`
+	Registered   bool       `json:"registered"`
+	RegisteredAt *time.Time `json:"registered_at,omitempty"`
+	Private      bool       `json:"private"`
+	Retention    string     `json:"retention"`           // how long yoinks are kept, 0s means forever
+	MaxYoinks    int64      `json:"max_yoinks"`          // how many of the latest yoinks are kept, 0 means all of them
+	Key          string     `json:"key,omitempty"`       // only returned when the topic is registered
+	ReadKey      string     `json:"read_key,omitempty"`  // only returned when the topic is registered as private
+	OwnerKey     string     `json:"owner_key,omitempty"` // only returned when the topic is registered
+}
+
+// topicAccess holds what's needed to check access to a topic
+// A topic that isn't registered has no key hash and is open to everyone
+type topicAccess struct {
+	keyHash      string
+	private      bool
+	readKeyHash  string
+	ownerKeyHash string // empty for topics registered before owner keys existed
+}
+
+// ownerHash returns the hash of the key that manages the topic
+// Topics registered before owner keys existed are managed with their key, or their read key when they're private
+// so the devices publishing to a private topic still can't make it readable
+func (a topicAccess) ownerHash() string {
+	if a.ownerKeyHash != "" {
+		return a.ownerKeyHash
+	}
+	if a.private {
+		return a.readKeyHash
+	}
+	return a.keyHash
+}
+
+// requestKey returns the topic key sent with a request, the header takes precedence over the query parameter
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get(topicKeyHeader); key != "" {
+		return key
+	}
+	return r.URL.Query().Get(topicKeyParam)
+}
+
+// hashKey hashes a key with PBKDF2-HMAC-SHA256 and a random salt
+func hashKey(key string) (string, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	hash := pbkdf2SHA256([]byte(key), salt, keyHashIterations)
+	return keyHashPrefix + "$" + strconv.Itoa(keyHashIterations) + "$" + hex.EncodeToString(salt) + "$" + hex.EncodeToString(hash), nil
+}
+
+// checkKey reports whether a key matches a hash made by hashKey
+func checkKey(key, keyHash string) bool {
+	parts := strings.Split(keyHash, "$")
+	if len(parts) != 4 || parts[0] != keyHashPrefix {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(key), salt, iterations), expected) == 1
+}
+
+// pbkdf2SHA256 derives a 32 byte key as described in RFC 8018, which only needs a single block with SHA-256
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	block := make([]byte, 4)
+	binary.BigEndian.PutUint32(block, 1)
+	mac.Write(salt)
+	mac.Write(block)
+	u := mac.Sum(nil)
+
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+// topicAccessFor returns the hashes of the keys of a topic and whether it's private
+// It runs for most requests, so it reads through the read pool and doesn't wait for connections busy writing
+func topicAccessFor(topic string) (topicAccess, error) {
+	access := topicAccess{}
+	err := readPool().QueryRow(
+		`SELECT key_hash, private, read_key_hash, owner_key_hash FROM registered_topics WHERE topic = ?;`,
+		topic,
+	).Scan(&access.keyHash, &access.private, &access.readKeyHash, &access.ownerKeyHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return topicAccess{}, nil
+	}
+	return access, err
+}
+
+// authorizeTopic checks that credentials allow publishing to a topic
+// Topics that aren't registered are open to everyone, registered ones need their key or a token scoped to them
+func authorizeTopic(topic string, creds credentials) error {
+	if creds.claims.canPublish(topic) {
+		return nil
+	}
+	access, err := topicAccessFor(topic)
+	if err != nil {
+		return NewHTTPError(err.Error(), http.StatusInternalServerError, "Error getting data from database")
+	}
+	if access.keyHash == "" {
+		return nil
+	}
+	if creds.key == "" {
+		if creds.claims != nil {
+			return NewHTTPError("token does not allow publishing to topic "+topic, http.StatusForbidden, "Forbidden")
+		}
+		return NewHTTPError("topic "+topic+" is registered and requires a key or a token", http.StatusUnauthorized, "Unauthorized")
+	}
+	if !checkKey(creds.key, access.keyHash) {
+		return NewHTTPError("key is not valid for topic "+topic, http.StatusForbidden, "Forbidden")
+	}
+	return nil
+}
+
+// authorizeRead checks that credentials allow reading a topic
+// Everyone can read topics that aren't private, private topics need a token scoped to them or their read key,
+// which is different from the key used to publish so devices can't read what they publish
+func authorizeRead(topic string, creds credentials) error {
+	if creds.claims.canRead(topic) {
+		return nil
+	}
+
+	access, err := topicAccessFor(topic)
+	if err != nil {
+		return NewHTTPError(err.Error(), http.StatusInternalServerError, "Error getting data from database")
+	}
+	if !access.private {
+		return nil
+	}
+	if creds.key == "" {
+		if creds.claims != nil {
+			return NewHTTPError("token does not allow reading topic "+topic, http.StatusForbidden, "Forbidden")
+		}
+		return NewHTTPError("topic "+topic+" is private and requires a read key or a token", http.StatusUnauthorized, "Unauthorized")
+	}
+	if !checkKey(creds.key, access.readKeyHash) {
+		return NewHTTPError("read key is not valid for topic "+topic, http.StatusForbidden, "Forbidden")
+	}
+	return nil
+}
+
+// authorizeOwner checks that credentials allow managing a topic
+// Registered topics are managed with their owner key, which can't publish or read, so neither the key of a topic
+// nor its read key can make it public or send its yoinks elsewhere
+// Tokens manage the topics they can publish to, and private ones only if they can read them as well
+func authorizeOwner(topic string, creds credentials) error {
+	access, err := topicAccessFor(topic)
+	if err != nil {
+		return NewHTTPError(err.Error(), http.StatusInternalServerError, "Error getting data from database")
+	}
+	return checkOwner(topic, access, creds)
+}
+
+// checkOwner checks credentials against the access of a topic that has already been looked up
+func checkOwner(topic string, access topicAccess, creds credentials) error {
+	if access.keyHash == "" {
+		return nil
+	}
+	if creds.claims.canPublish(topic) && (!access.private || creds.claims.canRead(topic)) {
+		return nil
+	}
+	if creds.key == "" {
+		if creds.claims != nil {
+			return NewHTTPError("token does not allow managing topic "+topic, http.StatusForbidden, "Forbidden")
+		}
+		return NewHTTPError("topic "+topic+" is registered and requires its owner key or a token", http.StatusUnauthorized, "Unauthorized")
+	}
+	if !checkKey(creds.key, access.ownerHash()) {
+		return NewHTTPError("key is not the owner key of topic "+topic, http.StatusForbidden, "Forbidden")
+	}
+	return nil
+}
+
+// requireTopicOwner is a middleware that only lets requests allowed to manage the topic in the URL through
+func requireTopicOwner(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := authorizeOwner(chi.URLParam(r, "topic"), requestCredentials(r))
+		if err != nil {
+			e := asHTTPError(err)
+			w.WriteHeader(e.Status)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireReadAccess is a middleware that only lets requests allowed to read the topic in the URL through
+func requireReadAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := authorizeRead(chi.URLParam(r, "topic"), requestCredentials(r))
+		if err != nil {
+			e := asHTTPError(err)
+			w.WriteHeader(e.Status)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireRegisteredTopic is a middleware that only lets requests for registered topics through
+// It goes after requireTopicOwner, which lets everyone manage topics that aren't registered since they have no owner,
+// so what only the owner should see or change, like webhooks, can't be reached on them
+func requireRegisteredTopic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		topic := chi.URLParam(r, "topic")
+		access, err := topicAccessFor(topic)
+		if err != nil {
+			e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error getting data from database")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+		if access.keyHash == "" {
+			e := NewHTTPError("topic "+topic+" must be registered first", http.StatusConflict, "Conflict")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GetTopic returns the metadata of a topic
+func GetTopic(w http.ResponseWriter, r *http.Request) {
+	topic, err := topicMetadata(chi.URLParam(r, "topic"))
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error getting data from database")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(topic)
+}
+
+// topicMetadata returns the metadata of a topic, which is the same for every topic that isn't registered
+func topicMetadata(name string) (*Topic, error) {
+	topic := &Topic{Name: name, Retention: retention.String()}
+	registeredAt := time.Time{}
+	retentionMs := sql.NullInt64{}
+	maxYoinks := sql.NullInt64{}
+	err := db.QueryRow(
+		`SELECT registered_at, private, retention_ms, max_yoinks FROM registered_topics WHERE topic = ?;`,
+		name,
+	).Scan(timeScanner{&registeredAt}, &topic.Private, &retentionMs, &maxYoinks)
+	if errors.Is(err, sql.ErrNoRows) {
+		return topic, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	topic.Registered = true
+	topic.RegisteredAt = &registeredAt
+	topic.Retention = retentionFromMs(retentionMs, registeredRetention).String()
+	topic.MaxYoinks = maxYoinks.Int64
+	return topic, nil
+}
+
+// UpdateTopic changes the settings of a registered topic
+// The body is a JSON object with the settings to change, a retention of "" goes back to the default
+// Setting max_yoinks deletes the yoinks that are over it right away
+// It goes through requireTopicOwner so only the owner gets here
+func (s *server) UpdateTopic(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "topic")
+	body, err := readJSONBody(r)
+	if err != nil {
+		e := &HTTPError{}
+		if !errors.As(err, &e) {
+			e = &HTTPError{Cause: err.Error(), Detail: "Bad Request", Status: http.StatusBadRequest}
+		}
+		w.WriteHeader(e.Status)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	req := struct {
+		Retention *string `json:"retention"`
+		MaxYoinks *int64  `json:"max_yoinks"`
+	}{}
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error decoding topic settings")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	sets := []string{}
+	args := []interface{}{}
+	if req.Retention != nil {
+		retentionMs := sql.NullInt64{}
+		if *req.Retention != "" {
+			d, err := time.ParseDuration(*req.Retention)
+			if err != nil || d < 0 {
+				e := NewHTTPError("retention is not a valid duration", http.StatusBadRequest, "Error validating topic settings")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(e)
+				return
+			}
+			retentionMs = sql.NullInt64{Int64: d.Milliseconds(), Valid: true}
+		}
+		sets = append(sets, "retention_ms = ?")
+		args = append(args, retentionMs)
+	}
+	if req.MaxYoinks != nil {
+		if *req.MaxYoinks < 0 {
+			e := NewHTTPError("max_yoinks can't be negative", http.StatusBadRequest, "Error validating topic settings")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+		sets = append(sets, "max_yoinks = ?")
+		args = append(args, sql.NullInt64{Int64: *req.MaxYoinks, Valid: *req.MaxYoinks > 0})
+	}
+	if len(sets) > 0 {
+		err = updateTopicSettings(name, strings.Join(sets, ", "), args...)
+		if err != nil {
+			e := asHTTPError(err)
+			w.WriteHeader(e.Status)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+	}
+	if req.MaxYoinks != nil && *req.MaxYoinks > 0 {
+		_, err = s.store.Trim(r.Context(), name, int(*req.MaxYoinks))
+		if err != nil {
+			e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error deleting yoinks over the cap")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+	}
+
+	topic, err := topicMetadata(name)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error getting data from database")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(topic)
+}
+
+// updateTopicSettings changes the settings of a registered topic
+func updateTopicSettings(topic, sets string, args ...interface{}) error {
+	res, err := db.Exec(`UPDATE registered_topics SET `+sets+` WHERE topic = ?;`, append(args, topic)...)
+	if err != nil {
+		return NewHTTPError(err.Error(), http.StatusInternalServerError, "Error updating topic in database")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NewHTTPError("only registered topics have settings", http.StatusConflict, "Conflict")
+	}
+	yoinkCaps.reset()
+	return nil
+}
+
+// RegisterTopic claims a topic so publishing to it requires a key
+// The body is an optional JSON object with the key, which is generated if it's left out and is only ever returned here
+// Private topics also get a read key, which is generated the same way
+// Every registered topic also gets an owner key that manages it, generated the same way
+// Registering a topic again with its owner key replaces the keys and whether it's private
+func RegisterTopic(w http.ResponseWriter, r *http.Request) {
+	topic := &Topic{Name: chi.URLParam(r, "topic")}
+	if topic.Name == "" {
+		e := NewHTTPError("topic is empty", http.StatusBadRequest, "Error validating topic name")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	req := struct {
+		Key      string `json:"key"`
+		Private  bool   `json:"private"`
+		ReadKey  string `json:"read_key"`
+		OwnerKey string `json:"owner_key"`
+	}{}
+	if r.ContentLength != 0 {
+		body, err := readJSONBody(r)
+		if err != nil {
+			e := &HTTPError{}
+			if !errors.As(err, &e) {
+				e = &HTTPError{Cause: err.Error(), Detail: "Bad Request", Status: http.StatusBadRequest}
+			}
+			w.WriteHeader(e.Status)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error decoding registration")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+	}
+
+	if req.ReadKey != "" && !req.Private {
+		e := NewHTTPError("read_key can only be used by private topics", http.StatusBadRequest, "Error validating topic key")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	if req.ReadKey != "" && req.ReadKey == req.Key {
+		e := NewHTTPError("read_key must be different from key", http.StatusBadRequest, "Error validating topic key")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	if req.OwnerKey != "" && (req.OwnerKey == req.Key || req.OwnerKey == req.ReadKey) {
+		e := NewHTTPError("owner_key must be different from key and read_key", http.StatusBadRequest, "Error validating topic key")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	keyHash, err := newTopicKey(&topic.Key, req.Key)
+	if err != nil {
+		e := asHTTPError(err)
+		w.WriteHeader(e.Status)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	topic.Private = req.Private
+	readKeyHash := ""
+	if topic.Private {
+		readKeyHash, err = newTopicKey(&topic.ReadKey, req.ReadKey)
+		if err != nil {
+			e := asHTTPError(err)
+			w.WriteHeader(e.Status)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+	}
+	ownerKeyHash, err := newTopicKey(&topic.OwnerKey, req.OwnerKey)
+	if err != nil {
+		e := asHTTPError(err)
+		w.WriteHeader(e.Status)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error starting transaction")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	defer tx.Rollback()
+
+	// A topic that's already registered can only have its keys replaced by its owner
+	current := topicAccess{}
+	err = tx.QueryRow(
+		`SELECT key_hash, private, read_key_hash, owner_key_hash FROM registered_topics WHERE topic = ?;`,
+		topic.Name,
+	).Scan(&current.keyHash, &current.private, &current.readKeyHash, &current.ownerKeyHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error getting data from database")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	status := http.StatusCreated
+	if current.keyHash != "" {
+		if checkOwner(topic.Name, current, requestCredentials(r)) != nil {
+			e := NewHTTPError("topic "+topic.Name+" is already registered", http.StatusConflict, "Conflict")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+		status = http.StatusOK
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO registered_topics (topic, key_hash, private, read_key_hash, owner_key_hash, registered_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (topic) DO UPDATE SET
+			key_hash = excluded.key_hash, private = excluded.private, read_key_hash = excluded.read_key_hash, owner_key_hash = excluded.owner_key_hash;`,
+		topic.Name,
+		keyHash,
+		topic.Private,
+		readKeyHash,
+		ownerKeyHash,
+		time.Now().UTC().Format(timestampLayout),
+	)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error inserting topic to database")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	// The rest of the topic is returned like GetTopic returns it, along with the keys that are only returned here
+	registered, err := topicMetadata(topic.Name)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error getting data from database")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	registered.Key, registered.ReadKey, registered.OwnerKey = topic.Key, topic.ReadKey, topic.OwnerKey
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(registered)
+}
+
+// newTopicKey sets key to the requested key, or a generated one if none was requested, and returns its hash
+func newTopicKey(key *string, requested string) (string, error) {
+	*key = requested
+	if *key == "" {
+		generated, err := generateSecret()
+		if err != nil {
+			return "", NewHTTPError(err.Error(), http.StatusInternalServerError, "Error generating topic key")
+		}
+		*key = generated
+	}
+	if len(*key) < minTopicKeyLength {
+		return "", NewHTTPError("keys must be at least "+strconv.Itoa(minTopicKeyLength)+" characters long", http.StatusBadRequest, "Error validating topic key")
+	}
+	keyHash, err := hashKey(*key)
+	if err != nil {
+		return "", NewHTTPError(err.Error(), http.StatusInternalServerError, "Error hashing topic key")
+	}
+	return keyHash, nil
+}
+
+// UnregisterTopic releases a registered topic so anyone can publish to it again
+// It goes through requireTopicOwner so only the owner gets here
+func UnregisterTopic(w http.ResponseWriter, r *http.Request) {
+	topic := chi.URLParam(r, "topic")
+	tx, err := db.Begin()
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error starting transaction")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM registered_topics WHERE topic = ?;`, topic)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error deleting topic from database")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		e := NewHTTPError("topic "+topic+" is not registered", http.StatusNotFound, "Not Found")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	// Webhooks and alert rules belong to the owner, they'd be left without one and passed on to whoever registers the topic next
+	_, err = tx.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE topic = ?);`, topic)
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM webhooks WHERE topic = ?;`, topic)
+	}
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM alert_rules WHERE topic = ?;`, topic)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	yoinkCaps.reset()
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error deleting topic from database")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteTopicYoinks deletes every yoink of a registered topic, the registration itself is kept
+// Topics that aren't registered can't be deleted since anyone could delete them
+// It goes through requireTopicOwner so only the owner gets here
+func (s *server) DeleteTopicYoinks(w http.ResponseWriter, r *http.Request) {
+	topic := chi.URLParam(r, "topic")
+	access, err := topicAccessFor(topic)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error getting data from database")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	if access.keyHash == "" {
+		e := NewHTTPError("only the yoinks of registered topics can be deleted", http.StatusConflict, "Conflict")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	_, err = s.store.DeleteTopic(r.Context(), topic)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error deleting yoinks from database")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// registerTopic registers a topic through the API, sending the current key if there is one
+func registerTopic(t *testing.T, topic, body, currentKey string) (int, *Topic) {
+	req := httptest.NewRequest(http.MethodPost, "/topics/"+topic+"/register", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if currentKey != "" {
+		req.Header.Set(topicKeyHeader, currentKey)
+	}
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated && w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	topicInfo := &Topic{}
+	err := json.NewDecoder(w.Body).Decode(topicInfo)
+	if err != nil {
+		t.Fatalf("decoding response failed: %v", err)
+	}
+	return w.Code, topicInfo
+}
+
+// publishWithKey publishes a yoink with the key in the header and returns the status code
+func publishWithKey(topic, data, key string) int {
+	req := httptest.NewRequest(http.MethodGet, "/publish/yoink/for/"+topic+"?"+data, nil)
+	if key != "" {
+		req.Header.Set(topicKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	return w.Code
+}
+
+// TestPBKDF2SHA256 checks key derivation against the test vectors of RFC 7914
+func TestPBKDF2SHA256(t *testing.T) {
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		expected   string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+
+	for _, tt := range tests {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations))
+		if got != tt.expected {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d): expected %s got %s", tt.password, tt.salt, tt.iterations, tt.expected, got)
+		}
+	}
+
+	keyHash, err := hashKey("hunter22")
+	if err != nil {
+		t.Fatalf("hashing key failed: %v", err)
+	}
+	if !checkKey("hunter22", keyHash) || checkKey("hunter23", keyHash) || checkKey("hunter22", "hunter22") {
+		t.Fatalf("key hash %s does not check out", keyHash)
+	}
+}
+
+func TestRegisteredTopic(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	code, _ := registerTopic(t, "testtopic", `{"key":"short"}`, "")
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected status %d got %d", http.StatusBadRequest, code)
+	}
+	code, _ = registerTopic(t, "testtopic", `{"key":"hunter22","owner_key":"hunter22"}`, "")
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected status %d got %d", http.StatusBadRequest, code)
+	}
+	code, topicInfo := registerTopic(t, "testtopic", `{"key":"hunter22"}`, "")
+	if code != http.StatusCreated || !topicInfo.Registered || topicInfo.Key != "hunter22" || len(topicInfo.OwnerKey) != 64 {
+		t.Fatalf("expected topic to be registered with a generated owner key got status %d", code)
+	}
+
+	// Only the owner can register it again, which replaces the keys
+	for _, currentKey := range []string{"", "hunter22"} {
+		code, _ = registerTopic(t, "testtopic", "", currentKey)
+		if code != http.StatusConflict {
+			t.Fatalf("expected status %d with key %q got %d", http.StatusConflict, currentKey, code)
+		}
+	}
+	code, topicInfo = registerTopic(t, "testtopic", "", topicInfo.OwnerKey)
+	if code != http.StatusOK || len(topicInfo.Key) != 64 || len(topicInfo.OwnerKey) != 64 {
+		t.Fatalf("expected keys to be replaced got status %d", code)
+	}
+	key, ownerKey := topicInfo.Key, topicInfo.OwnerKey
+
+	// Publishing needs the key now
+	if code := publishWithKey("testtopic", "tempreading=25", ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d got %d", http.StatusUnauthorized, code)
+	}
+	if code := publishWithKey("testtopic", "tempreading=25", "hunter22"); code != http.StatusForbidden {
+		t.Fatalf("expected status %d got %d", http.StatusForbidden, code)
+	}
+	if code := publishWithKey("testtopic", "tempreading=25", key); code != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, code)
+	}
+
+	// The key can be a query parameter and is not stored
+	y, err := publishYoink("testtopic", "tempreading=26&key="+key)
+	if err != nil {
+		t.Fatalf("publish yoink failed: %v", err)
+	}
+	if _, ok := y.Content["key"]; ok || y.Content["tempreading"] != 26.0 {
+		t.Fatalf("expected content without key got %v", y.Content)
+	}
+
+	// Batches and topic management need the key too
+	batch := `[{"topic":"othertopic","content":{"a":1}},{"topic":"testtopic","content":{"a":2}}]`
+	req := httptest.NewRequest(http.MethodPost, "/yoinks", strings.NewReader(batch))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized || countYoinks(t, "othertopic") != 0 {
+		t.Fatalf("expected status %d got %d", http.StatusUnauthorized, w.Code)
+	}
+	code, _ = createWebhook(t, "testtopic", `{"url":"http://example.com/hook"}`, "")
+	if code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d got %d", http.StatusUnauthorized, code)
+	}
+
+	// Managing it needs the owner key, the key only publishes
+	code, _ = createWebhook(t, "testtopic", `{"url":"http://example.com/hook"}`, key)
+	if code != http.StatusForbidden {
+		t.Fatalf("expected status %d got %d", http.StatusForbidden, code)
+	}
+	if code := publishWithKey("testtopic", "tempreading=25", ownerKey); code != http.StatusForbidden {
+		t.Fatalf("expected status %d got %d", http.StatusForbidden, code)
+	}
+
+	// Once released anyone can publish again
+	req = httptest.NewRequest(http.MethodDelete, "/topics/testtopic/register?key="+ownerKey, nil)
+	w = httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d got %d", http.StatusNoContent, w.Code)
+	}
+	if code := publishWithKey("testtopic", "tempreading=25", ""); code != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/topics/testtopic", nil)
+	w = httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	topicInfo = &Topic{}
+	err = json.NewDecoder(w.Body).Decode(topicInfo)
+	if err != nil || topicInfo.Registered || topicInfo.Name != "testtopic" {
+		t.Fatalf("expected unregistered topic got %+v", topicInfo)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+// readWithKey reads the yoinks of a topic with the key in the header and returns the status code
+func readWithKey(path, key string) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if key != "" {
+		req.Header.Set(topicKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestPrivateTopic(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	for _, body := range []string{`{"read_key":"readonly1"}`, `{"private":true,"key":"hunter22","read_key":"hunter22"}`, `{"private":true,"read_key":"short"}`} {
+		code, _ := registerTopic(t, "testtopic", body, "")
+		if code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s got %d", http.StatusBadRequest, body, code)
+		}
+	}
+	code, topicInfo := registerTopic(t, "testtopic", `{"private":true,"key":"hunter22","owner_key":"hunter22-owner"}`, "")
+	if code != http.StatusCreated || !topicInfo.Private || len(topicInfo.ReadKey) != 64 {
+		t.Fatalf("expected private topic with generated read key got status %d", code)
+	}
+	readKey := topicInfo.ReadKey
+
+	// The write key only publishes and the read key only reads
+	if code := publishWithKey("testtopic", "tempreading=25", readKey); code != http.StatusForbidden {
+		t.Fatalf("expected status %d got %d", http.StatusForbidden, code)
+	}
+	if code := publishWithKey("testtopic", "tempreading=25", "hunter22"); code != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, code)
+	}
+	for _, path := range []string{"/yoink/testtopic", "/yoinks/testtopic", "/get/last/1/yoinks/from/testtopic", "/get/latest/yoink/from/testtopic"} {
+		if code := readWithKey(path, ""); code != http.StatusUnauthorized {
+			t.Fatalf("expected status %d for %s got %d", http.StatusUnauthorized, path, code)
+		}
+		if code := readWithKey(path, "hunter22"); code != http.StatusForbidden {
+			t.Fatalf("expected status %d for %s got %d", http.StatusForbidden, path, code)
+		}
+		if code := readWithKey(path+"?key="+readKey, ""); code != http.StatusOK {
+			t.Fatalf("expected status %d for %s got %d", http.StatusOK, path, code)
+		}
+	}
+
+	// Neither the write key nor the read key can make it public or send its yoinks elsewhere
+	for _, key := range []string{"hunter22", readKey} {
+		code, _ = registerTopic(t, "testtopic", `{"key":"hunter22"}`, key)
+		if code != http.StatusConflict {
+			t.Fatalf("expected status %d got %d", http.StatusConflict, code)
+		}
+		code, _ = updateTopic(t, "testtopic", `{"retention":"1h"}`, key)
+		if code != http.StatusForbidden {
+			t.Fatalf("expected status %d got %d", http.StatusForbidden, code)
+		}
+		code, _ = createWebhook(t, "testtopic", `{"url":"http://example.com/hook"}`, key)
+		if code != http.StatusForbidden {
+			t.Fatalf("expected status %d got %d", http.StatusForbidden, code)
+		}
+		code, _ = createAlertRule(t, "testtopic", `{"condition":"content.tempreading > 0","alert_topic":"alerts"}`, key)
+		if code != http.StatusForbidden {
+			t.Fatalf("expected status %d got %d", http.StatusForbidden, code)
+		}
+	}
+	if code := readWithKey("/yoinks/testtopic", ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d got %d", http.StatusUnauthorized, code)
+	}
+
+	// Registering again with the owner key without private makes it public
+	code, topicInfo = registerTopic(t, "testtopic", `{"key":"hunter22"}`, "hunter22-owner")
+	if code != http.StatusOK || topicInfo.Private || topicInfo.ReadKey != "" {
+		t.Fatalf("expected public topic got status %d", code)
+	}
+	if code := readWithKey("/yoinks/testtopic", ""); code != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, code)
+	}
+
+	// Topics registered before owner keys existed are managed with their read key when they're private
+	readKeyHash, err := hashKey("readonly1")
+	if err == nil {
+		_, err = db.Exec(`UPDATE registered_topics SET owner_key_hash = '', private = TRUE, read_key_hash = ? WHERE topic = 'testtopic';`, readKeyHash)
+	}
+	if err != nil {
+		t.Fatalf("updating topic failed: %v", err)
+	}
+	if code, _ := updateTopic(t, "testtopic", `{"retention":"1h"}`, "hunter22"); code != http.StatusForbidden {
+		t.Fatalf("expected status %d got %d", http.StatusForbidden, code)
+	}
+	if code, _ := updateTopic(t, "testtopic", `{"retention":"1h"}`, "readonly1"); code != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, code)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultMaxWait is the longest a client can wait for a new yoink when none is configured
+const defaultMaxWait = 60 * time.Second
+
+// maxWait is the longest a client can wait for a new yoink, longer waits are shortened to it
+var maxWait = defaultMaxWait
+
+// waitCondition describes the yoink a long-polling client is waiting for
+type waitCondition struct {
+	afterID int64     // the yoink must have been stored after the one with this id
+	after   time.Time // the yoink must be timestamped after this, zero means any time
+}
+
+// matches reports whether a yoink is one the client is waiting for
+func (c waitCondition) matches(y *Yoink) bool {
+	return y.ID > c.afterID && (c.after.IsZero() || y.Timestamp.After(c.after))
+}
+
+// parseWait reads the wait, after_id and after query parameters of a long-polling request
+// wait is a duration like 30s or a number of seconds, capped at maxWait, and zero means not waiting
+// Without after_id or after the client waits for the next yoink to be stored
+func parseWait(r *http.Request) (time.Duration, waitCondition, error) {
+	cond := waitCondition{afterID: -1}
+	queryParams := r.URL.Query()
+
+	value := queryParams.Get("wait")
+	if value == "" {
+		return 0, cond, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, cond, errors.New("wait is neither a duration nor a number of seconds")
+		}
+		wait = time.Duration(seconds * float64(time.Second))
+	}
+	if wait < 0 {
+		return 0, cond, errors.New("wait is negative")
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+
+	if value := queryParams.Get("after_id"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || id < 0 {
+			return 0, cond, errors.New("after_id is not a positive number")
+		}
+		cond.afterID = id
+	}
+	if value := queryParams.Get("after"); value != "" {
+		after, err := parseTimeBound(value, time.Now().UTC())
+		if err != nil {
+			return 0, cond, errors.New("after: " + err.Error())
+		}
+		cond.after = after
+	}
+	return wait, cond, nil
+}
+
+// waitForYoink replies with the newest yoink of the topic matching the condition, waiting for it to be stored if needed
+// If nothing shows up in time the reply is 204 No Content
+func (s *server) waitForYoink(w http.ResponseWriter, r *http.Request, topic string, wait time.Duration, cond waitCondition) {
+	// Subscribe before looking in the store so nothing stored in between is missed
+	sub := yoinkHub.subscribe(topic)
+	defer func() { yoinkHub.unsubscribe(sub) }()
+
+	// Without a condition, wait for whatever comes after the newest yoink stored so far
+	if cond.afterID < 0 {
+		id, err := s.store.LastID(r.Context(), topic)
+		if err != nil {
+			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error getting data from database")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+		cond.afterID = id
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		y, err := s.store.Latest(r.Context(), topic, cond)
+		if err != nil {
+			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error getting data from database")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+
+	listen:
+		for y == nil {
+			select {
+			case stored := <-sub.yoinks:
+				if cond.matches(stored) {
+					y = stored
+				}
+			case <-sub.dropped:
+				// Too many yoinks came in to keep up, so subscribe again and look in the store
+				sub = yoinkHub.subscribe(topic)
+				break listen
+			case <-timer.C:
+				w.WriteHeader(http.StatusNoContent)
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if y != nil {
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(y)
+			return
+		}
+	}
+}
+
+// writeTimeoutFor is middleware that gives the routes it's used on d to write their response instead of writeTimeout
+func writeTimeoutFor(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			extendWriteDeadline(r, d)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
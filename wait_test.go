@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// getLatest requests the latest yoink of a topic and decodes the response if there is one
+func getLatest(t *testing.T, path string) (int, *Yoink) {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	y := &Yoink{}
+	err := json.NewDecoder(w.Body).Decode(y)
+	if err != nil {
+		t.Fatalf("decoding response failed: %v", err)
+	}
+	return w.Code, y
+}
+
+func TestGetLatestYoinkFromTopicWait(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	first, err := publishYoink("testtopic", "n=1")
+	if err != nil {
+		t.Fatalf("publish yoink failed: %v", err)
+	}
+
+	// A yoink newer than after_id already exists so there's no waiting
+	start := time.Now()
+	code, y := getLatest(t, "/yoink/testtopic?wait=5s&after_id=0")
+	if code != http.StatusOK || y.ID != first.ID || time.Since(start) > time.Second {
+		t.Fatalf("expected yoink %d right away got status %d", first.ID, code)
+	}
+
+	// Nothing new shows up in time
+	code, _ = getLatest(t, "/get/latest/yoink/from/testtopic?wait=200ms&after_id="+strconv.FormatInt(first.ID, 10))
+	if code != http.StatusNoContent {
+		t.Fatalf("expected status %d got %d", http.StatusNoContent, code)
+	}
+
+	// Waiting without a condition returns the next yoink published
+	published := make(chan *Yoink)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		publishYoink("othertopic", "n=2")
+		y, _ := publishYoink("testtopic", "n=3")
+		published <- y
+	}()
+	code, y = getLatest(t, "/yoink/testtopic?wait=5")
+	second := <-published
+	if code != http.StatusOK || second == nil || y.ID != second.ID {
+		t.Fatalf("expected the next yoink got status %d and %#v", code, y)
+	}
+
+	// Waiting for a yoink timestamped after a given time skips older ones
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		publishYoink("testtopic", "n=4&_timestamp=2022-10-26T11:00:00Z")
+		y, _ := publishYoink("testtopic", "n=5")
+		published <- y
+	}()
+	code, y = getLatest(t, "/yoink/testtopic?wait=5s&after_id="+strconv.FormatInt(second.ID, 10)+"&after="+time.Now().UTC().Format(time.RFC3339Nano))
+	third := <-published
+	if code != http.StatusOK || third == nil || y.ID != third.ID {
+		t.Fatalf("expected yoink timestamped after now got status %d and %#v", code, y)
+	}
+
+	for _, path := range []string{
+		"/yoink/testtopic?wait=soon",
+		"/yoink/testtopic?wait=-1s",
+		"/yoink/testtopic?wait=1s&after_id=first",
+		"/yoink/testtopic?wait=1s&after=yesterday",
+	} {
+		code, _ := getLatest(t, path)
+		if code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d got %d", path, http.StatusBadRequest, code)
+		}
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+// TestWriteTimeoutFor checks that routes can take longer than the write timeout of the server
+func TestWriteTimeoutFor(t *testing.T) {
+	timeout := 100 * time.Millisecond
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(3 * timeout)
+		w.Write([]byte("done"))
+	})
+	srv := httptest.NewUnstartedServer(writeTimeoutFor(10 * timeout)(slow))
+	srv.Config.WriteTimeout = timeout
+	srv.Config.ConnContext = saveConn
+	srv.Start()
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil || string(body) != "done" {
+		t.Fatalf("response was cut short: %q %v", body, err)
+	}
+}
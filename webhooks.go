@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// webhookQueueSize is how many deliveries can be waiting for a worker before new ones are dropped
+const webhookQueueSize = 1024
+
+// webhookWorkers is how many deliveries are made at the same time
+const webhookWorkers = 4
+
+// webhookSignatureHeader holds the HMAC-SHA256 of the body, keyed with the secret of the webhook
+const webhookSignatureHeader = "X-Yoink-Signature"
+
+// webhookMaxAttempts is how many times a delivery is tried before giving up
+var webhookMaxAttempts = 5
+
+// webhookBaseBackoff is how long to wait before the first retry, it doubles with every attempt
+var webhookBaseBackoff = time.Second
+
+// maxWebhookDeliveries is how many of the latest delivery attempts of each webhook are kept in its log
+var maxWebhookDeliveries = 1000
+
+// allowPrivateWebhooks lets webhooks be delivered to loopback, link-local and private addresses
+// It's off by default so whoever adds a webhook can't make the server send requests into the network it runs in
+var allowPrivateWebhooks = false
+
+// webhookDialer connects to webhooks, checking every address after the name of the host has been resolved
+// so a name that resolves to a private address, or starts to after the URL was validated, can't get around the check
+var webhookDialer = &net.Dialer{Timeout: 10 * time.Second, Control: checkWebhookAddress}
+
+// webhookClient makes the deliveries, without a timeout a slow receiver would keep a worker forever
+// It never goes through a proxy since the addresses behind it couldn't be checked
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         webhookDialer.DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// webhookQueue holds the deliveries waiting for a worker
+var webhookQueue = make(chan webhookJob, webhookQueueSize)
+
+// startWebhookWorkersOnce makes sure there is only one set of workers
+var startWebhookWorkersOnce sync.Once
+
+// webhookWorkersStarted is set once there are workers, until then nothing is queued
+var webhookWorkersStarted int32
+
+// Webhook is a URL that yoinks of a topic are delivered to as they are stored
+type Webhook struct {
+	ID        int64     `json:"id"`
+	Topic     string    `json:"topic"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"` // only returned when the webhook is created
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is an attempt to deliver a yoink to a webhook
+type WebhookDelivery struct {
+	ID          int64     `json:"id"`
+	WebhookID   int64     `json:"webhook_id"`
+	YoinkID     int64     `json:"yoink_id"`
+	Attempt     int       `json:"attempt"`
+	StatusCode  int       `json:"status_code"` // 0 if no response was received
+	Error       string    `json:"error"`
+	Succeeded   bool      `json:"succeeded"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+// webhookJob is a delivery waiting for a worker
+// Jobs without a webhook are fanned out to every webhook of the topic of the yoink
+type webhookJob struct {
+	yoink   *Yoink
+	webhook *Webhook
+	attempt int
+}
+
+// startWebhookWorkers starts the goroutines that deliver yoinks to webhooks
+func startWebhookWorkers() {
+	startWebhookWorkersOnce.Do(func() {
+		for i := 0; i < webhookWorkers; i++ {
+			go func() {
+				for job := range webhookQueue {
+					runWebhookJob(job)
+				}
+			}()
+		}
+		atomic.StoreInt32(&webhookWorkersStarted, 1)
+	})
+}
+
+// enqueueWebhooks schedules the delivery of a stored yoink to the webhooks of its topic
+// It never blocks publishing, if the queue is full the yoink is not delivered
+func enqueueWebhooks(y *Yoink) {
+	if atomic.LoadInt32(&webhookWorkersStarted) == 0 {
+		return
+	}
+	select {
+	case webhookQueue <- webhookJob{yoink: y}:
+	default:
+		log.Println("webhook queue is full, not delivering yoink", y.ID)
+	}
+}
+
+// runWebhookJob fans a yoink out to the webhooks of its topic or makes a single delivery attempt
+func runWebhookJob(job webhookJob) {
+	if job.webhook == nil {
+		hooks, err := topicWebhooks(job.yoink.Topic)
+		if err != nil {
+			log.Println("looking up webhooks failed:", err)
+			return
+		}
+		for _, hook := range hooks {
+			deliverWebhook(webhookJob{yoink: job.yoink, webhook: hook, attempt: 1})
+		}
+		return
+	}
+	deliverWebhook(job)
+}
+
+// deliverWebhook makes one attempt to deliver a yoink, logs it and schedules a retry with exponential backoff if it failed
+func deliverWebhook(job webhookJob) {
+	// Retries hold on to the webhook they were first made with, which may have been deleted since
+	if job.attempt > 1 {
+		exists, err := webhookExists(job.webhook.ID)
+		if err != nil {
+			log.Println("looking up webhook", job.webhook.ID, "failed:", err)
+			return
+		}
+		if !exists {
+			return
+		}
+	}
+
+	delivery := &WebhookDelivery{
+		WebhookID:   job.webhook.ID,
+		YoinkID:     job.yoink.ID,
+		Attempt:     job.attempt,
+		AttemptedAt: time.Now().UTC(),
+	}
+
+	err := postWebhook(job.webhook, job.yoink, delivery)
+	if err != nil {
+		delivery.Error = err.Error()
+	} else {
+		delivery.Succeeded = true
+	}
+
+	err = logWebhookDelivery(delivery)
+	if err != nil {
+		log.Println("logging webhook delivery failed:", err)
+	}
+
+	if delivery.Succeeded || job.attempt >= webhookMaxAttempts {
+		return
+	}
+	backoff := webhookBaseBackoff << (job.attempt - 1)
+	job.attempt++
+	time.AfterFunc(backoff, func() {
+		select {
+		case webhookQueue <- job:
+		default:
+			log.Println("webhook queue is full, giving up on delivering yoink", job.yoink.ID, "to webhook", job.webhook.ID)
+		}
+	})
+}
+
+// webhookExists reports whether a webhook hasn't been deleted
+func webhookExists(id int64) (bool, error) {
+	exists := false
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM webhooks WHERE id = ?);`, id).Scan(&exists)
+	return exists, err
+}
+
+// logWebhookDelivery adds a delivery attempt to the log of its webhook and drops the oldest ones over maxWebhookDeliveries
+// Nothing is logged for webhooks that were deleted while the attempt was being made
+func logWebhookDelivery(delivery *WebhookDelivery) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO webhook_deliveries (webhook_id, yoink_id, attempt, status_code, error, succeeded, attempted_at)
+		SELECT ?, ?, ?, ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM webhooks WHERE id = ?);`,
+		delivery.WebhookID,
+		delivery.YoinkID,
+		delivery.Attempt,
+		delivery.StatusCode,
+		delivery.Error,
+		delivery.Succeeded,
+		delivery.AttemptedAt.Format(timestampLayout),
+		delivery.WebhookID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`DELETE FROM webhook_deliveries WHERE webhook_id = ? AND id <= (
+			SELECT id FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT 1 OFFSET ?
+		);`,
+		delivery.WebhookID,
+		delivery.WebhookID,
+		maxWebhookDeliveries,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// postWebhook sends a yoink to a webhook, signing the body with the secret of the webhook
+func postWebhook(hook *Webhook, y *Yoink, delivery *WebhookDelivery) error {
+	body, err := json.Marshal(y)
+	if err != nil {
+		return err
+	}
+	deliveryID := strconv.FormatInt(hook.ID, 10) + "-" + strconv.FormatInt(y.ID, 10)
+	delivery.StatusCode, err = postSigned(hook.URL, hook.Secret, "yoink", deliveryID, body)
+	return err
+}
+
+// postSigned sends a JSON body to a URL, signed with the secret if there is one
+// It returns the status code of the response, any response other than 2xx counts as a failure
+func postSigned(target, secret, event, deliveryID string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "datayoinker-webhooks")
+	req.Header.Set("X-Yoink-Event", event)
+	req.Header.Set("X-Yoink-Delivery", deliveryID)
+	if secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookBody(secret, body))
+	}
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10)) // let the connection be reused
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, errors.New("webhook responded with " + res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// signWebhookBody returns the hex-encoded HMAC-SHA256 of the body keyed with the secret
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validWebhookURL reports whether a URL can be delivered to, which only absolute http(s) URLs can
+// Hosts that are addresses or localhost are checked here, names are checked when they are resolved for every delivery
+func validWebhookURL(value string) bool {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	if allowPrivateWebhooks {
+		return true
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || webhookAddressAllowed(ip)
+}
+
+// webhookAddressAllowed reports whether webhooks can be delivered to an address
+// Unless allowPrivateWebhooks is set that's only addresses that can be reached over the internet
+func webhookAddressAllowed(ip net.IP) bool {
+	if allowPrivateWebhooks {
+		return true
+	}
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// checkWebhookAddress refuses to connect to an address that webhooks can't be delivered to
+func checkWebhookAddress(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !webhookAddressAllowed(ip) {
+		return errors.New("webhooks can't be delivered to " + host)
+	}
+	return nil
+}
+
+// generateSecret returns 32 random bytes, hex-encoded
+func generateSecret() (string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// topicWebhooks returns the webhooks of a topic, secrets included
+func topicWebhooks(topic string) ([]*Webhook, error) {
+	rows, err := db.Query(`SELECT id, topic, url, secret, created_at FROM webhooks WHERE topic = ? ORDER BY id;`, topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []*Webhook{}
+	for rows.Next() {
+		hook := &Webhook{}
+		err = rows.Scan(&hook.ID, &hook.Topic, &hook.URL, &hook.Secret, timeScanner{&hook.CreatedAt})
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+// CreateWebhook registers a webhook for a topic
+// The body is a JSON object with the url and optionally the secret used to sign deliveries,
+// which is generated if it's left out and is only ever returned here
+func CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	topic := chi.URLParam(r, "topic")
+	if topic == "" {
+		e := NewHTTPError("topic is empty", http.StatusBadRequest, "Error validating topic name")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	body, err := readJSONBody(r)
+	if err != nil {
+		e := &HTTPError{}
+		if !errors.As(err, &e) {
+			e = &HTTPError{Cause: err.Error(), Detail: "Bad Request", Status: http.StatusBadRequest}
+		}
+		w.WriteHeader(e.Status)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	hook := &Webhook{}
+	err = json.Unmarshal(body, hook)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error decoding webhook")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	if !validWebhookURL(hook.URL) {
+		e := NewHTTPError("url must be an absolute http or https URL that isn't a loopback, link-local or private address", http.StatusBadRequest, "Error validating webhook")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	if hook.Secret == "" {
+		hook.Secret, err = generateSecret()
+		if err != nil {
+			e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error generating webhook secret")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+	}
+
+	err = db.QueryRow(
+		`INSERT INTO webhooks (topic, url, secret, created_at) VALUES (?, ?, ?, ?) RETURNING id, topic, created_at;`,
+		topic,
+		hook.URL,
+		hook.Secret,
+		time.Now().UTC().Format(timestampLayout),
+	).Scan(&hook.ID, &hook.Topic, timeScanner{&hook.CreatedAt})
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error inserting webhook to database")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+// GetWebhooks returns the webhooks of a topic without their secrets
+func GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	topic := chi.URLParam(r, "topic")
+	if topic == "" {
+		e := NewHTTPError("topic is empty", http.StatusBadRequest, "Error validating topic name")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	hooks, err := topicWebhooks(topic)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error getting data from database")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	for _, hook := range hooks {
+		hook.Secret = ""
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(hooks)
+}
+
+// DeleteWebhook removes a webhook of a topic along with its delivery log
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	topic := chi.URLParam(r, "topic")
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error parsing webhook id")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error starting transaction")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM webhooks WHERE id = ? AND topic = ?;`, id, topic)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error deleting webhook from database")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		e := NewHTTPError("webhook "+strconv.FormatInt(id, 10)+" of topic "+topic+" does not exist", http.StatusNotFound, "Not Found")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	_, err = tx.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id = ?;`, id)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "Error deleting webhook from database")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries returns the most recent delivery attempts of a webhook of a topic, newest first
+func GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	topic := chi.URLParam(r, "topic")
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error parsing webhook id")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	limit, err := parsePageLimit(r)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error validating page limit")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	rows, err := db.Query(
+		`SELECT d.id, d.webhook_id, d.yoink_id, d.attempt, d.status_code, d.error, d.succeeded, d.attempted_at
+		FROM webhook_deliveries d JOIN webhooks h ON h.id = d.webhook_id
+		WHERE h.id = ? AND h.topic = ? ORDER BY d.id DESC LIMIT ?;`,
+		id,
+		topic,
+		limit,
+	)
+	if err != nil {
+		e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error getting data from database")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		d := &WebhookDelivery{}
+		err = rows.Scan(&d.ID, &d.WebhookID, &d.YoinkID, &d.Attempt, &d.StatusCode, &d.Error, &d.Succeeded, timeScanner{&d.AttemptedAt})
+		if err != nil {
+			e := NewHTTPError(err.Error(), http.StatusBadRequest, "Error mapping query results to struct")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(deliveries)
+}
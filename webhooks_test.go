@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// createWebhook registers a webhook for a topic through the API with the key of the topic
+func createWebhook(t *testing.T, topic, body, key string) (int, *Webhook) {
+	req := httptest.NewRequest(http.MethodPost, "/topics/"+topic+"/webhooks", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(topicKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		return w.Code, nil
+	}
+	hook := &Webhook{}
+	err := json.NewDecoder(w.Body).Decode(hook)
+	if err != nil {
+		t.Fatalf("decoding response failed: %v", err)
+	}
+	return w.Code, hook
+}
+
+// getDeliveries returns the delivery log of a webhook through the API with the key of the topic
+func getDeliveries(t *testing.T, topic string, id int64, key string) []*WebhookDelivery {
+	req := httptest.NewRequest(http.MethodGet, "/topics/"+topic+"/webhooks/"+strconv.FormatInt(id, 10)+"/deliveries", nil)
+	req.Header.Set(topicKeyHeader, key)
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, w.Code)
+	}
+	deliveries := []*WebhookDelivery{}
+	err := json.NewDecoder(w.Body).Decode(&deliveries)
+	if err != nil {
+		t.Fatalf("decoding response failed: %v", err)
+	}
+	return deliveries
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+	initialBackoff := webhookBaseBackoff
+	webhookBaseBackoff = 10 * time.Millisecond
+	startWebhookWorkers()
+	// The receiver listens on a loopback address
+	allowPrivateWebhooks = true
+	defer func() { allowPrivateWebhooks = false }()
+	code, _ := registerTopic(t, "testtopic", `{"key":"hunter22","owner_key":"hunter22-owner"}`, "")
+	if code != http.StatusCreated {
+		t.Fatalf("expected topic to be registered got status %d", code)
+	}
+
+	// The receiver fails the first delivery so it has to be retried
+	received := make(chan *Yoink, 1)
+	attempts := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(webhookSignatureHeader) != "sha256="+signWebhookBody("hunter2", body) {
+			t.Errorf("signature %q does not match body", r.Header.Get(webhookSignatureHeader))
+		}
+		y := &Yoink{}
+		json.Unmarshal(body, y)
+		received <- y
+	}))
+	defer receiver.Close()
+
+	code, hook := createWebhook(t, "testtopic", `{"url":"`+receiver.URL+`","secret":"hunter2"}`, "hunter22-owner")
+	if code != http.StatusCreated || hook.Secret != "hunter2" {
+		t.Fatalf("expected webhook to be created got status %d", code)
+	}
+
+	published, err := publishYoink("testtopic", "tempreading=21&key=hunter22")
+	if err != nil {
+		t.Fatalf("publish yoink failed: %v", err)
+	}
+	select {
+	case y := <-received:
+		if y.ID != published.ID || y.Content["tempreading"] != 21.0 {
+			t.Fatalf("expected yoink %d got %d", published.ID, y.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("webhook was not delivered")
+	}
+
+	// The delivery log is written right after the response so give it a moment
+	var deliveries []*WebhookDelivery
+	for i := 0; i < 50; i++ {
+		deliveries = getDeliveries(t, "testtopic", hook.ID, "hunter22-owner")
+		if len(deliveries) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(deliveries) != 2 {
+		t.Fatalf("expected 2 deliveries got %d", len(deliveries))
+	}
+	if !deliveries[0].Succeeded || deliveries[0].Attempt != 2 || deliveries[0].StatusCode != http.StatusOK {
+		t.Fatalf("expected second attempt to succeed got %+v", deliveries[0])
+	}
+	if deliveries[1].Succeeded || deliveries[1].Attempt != 1 || deliveries[1].StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected first attempt to fail got %+v", deliveries[1])
+	}
+
+	webhookBaseBackoff = initialBackoff
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+// TestWebhookDeletedWhileRetrying checks that retries of a webhook that was deleted are dropped instead of delivered and logged
+func TestWebhookDeletedWhileRetrying(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+	initialBackoff := webhookBaseBackoff
+	webhookBaseBackoff = 100 * time.Millisecond
+	startWebhookWorkers()
+	allowPrivateWebhooks = true
+	defer func() { allowPrivateWebhooks = false }()
+	code, _ := registerTopic(t, "testtopic", `{"key":"hunter22","owner_key":"hunter22-owner"}`, "")
+	if code != http.StatusCreated {
+		t.Fatalf("expected topic to be registered got status %d", code)
+	}
+
+	// The receiver fails every delivery so it keeps being retried
+	failed := make(chan struct{}, webhookMaxAttempts)
+	attempts := int32(0)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+		failed <- struct{}{}
+	}))
+	defer receiver.Close()
+
+	code, hook := createWebhook(t, "testtopic", `{"url":"`+receiver.URL+`"}`, "hunter22-owner")
+	if code != http.StatusCreated {
+		t.Fatalf("expected webhook to be created got status %d", code)
+	}
+	_, err = publishYoink("testtopic", "tempreading=21&key=hunter22")
+	if err != nil {
+		t.Fatalf("publish yoink failed: %v", err)
+	}
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("webhook was not delivered")
+	}
+
+	path := "/topics/testtopic/webhooks/" + strconv.FormatInt(hook.ID, 10) + "?key=hunter22-owner"
+	req := httptest.NewRequest(http.MethodDelete, path, nil)
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d got %d", http.StatusNoContent, w.Code)
+	}
+
+	time.Sleep(4 * webhookBaseBackoff)
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Fatalf("expected no retries after the webhook was deleted got %d attempts", n)
+	}
+	count := 0
+	err = db.QueryRow(`SELECT COUNT(*) FROM webhook_deliveries WHERE webhook_id = ?;`, hook.ID).Scan(&count)
+	if err != nil || count != 0 {
+		t.Fatalf("expected no deliveries left for the deleted webhook got %d: %v", count, err)
+	}
+
+	webhookBaseBackoff = initialBackoff
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+// TestWebhookDeliveryLogIsCapped checks that only the latest delivery attempts of a webhook are kept
+func TestWebhookDeliveryLogIsCapped(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+	initialMax := maxWebhookDeliveries
+	maxWebhookDeliveries = 3
+	defer func() { maxWebhookDeliveries = initialMax }()
+	code, _ := registerTopic(t, "testtopic", `{"key":"hunter22","owner_key":"hunter22-owner"}`, "")
+	if code != http.StatusCreated {
+		t.Fatalf("expected topic to be registered got status %d", code)
+	}
+	_, hook := createWebhook(t, "testtopic", `{"url":"http://example.com/hook"}`, "hunter22-owner")
+	_, other := createWebhook(t, "testtopic", `{"url":"http://example.com/other"}`, "hunter22-owner")
+
+	for i := int64(1); i <= 5; i++ {
+		err = logWebhookDelivery(&WebhookDelivery{WebhookID: hook.ID, YoinkID: i, Attempt: 1, AttemptedAt: time.Now()})
+		if err != nil {
+			t.Fatalf("logging delivery failed: %v", err)
+		}
+	}
+	err = logWebhookDelivery(&WebhookDelivery{WebhookID: other.ID, YoinkID: 1, Attempt: 1, AttemptedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("logging delivery failed: %v", err)
+	}
+
+	deliveries := getDeliveries(t, "testtopic", hook.ID, "hunter22-owner")
+	if len(deliveries) != 3 || deliveries[0].YoinkID != 5 || deliveries[2].YoinkID != 3 {
+		t.Fatalf("expected the 3 latest deliveries got %+v", deliveries)
+	}
+	if deliveries := getDeliveries(t, "testtopic", other.ID, "hunter22-owner"); len(deliveries) != 1 {
+		t.Fatalf("expected the log of the other webhook to be kept got %d deliveries", len(deliveries))
+	}
+
+	// Attempts for webhooks that don't exist anymore aren't logged
+	err = logWebhookDelivery(&WebhookDelivery{WebhookID: other.ID + 100, YoinkID: 1, Attempt: 1, AttemptedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("logging delivery failed: %v", err)
+	}
+	count := 0
+	err = db.QueryRow(`SELECT COUNT(*) FROM webhook_deliveries;`).Scan(&count)
+	if err != nil || count != 4 {
+		t.Fatalf("expected 4 deliveries got %d: %v", count, err)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+func TestWebhookManagement(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+
+	// Topics that aren't registered have no owner, so nobody can add webhooks to them
+	code, _ := createWebhook(t, "testtopic", `{"url":"http://example.com/hook"}`, "")
+	if code != http.StatusConflict {
+		t.Fatalf("expected status %d got %d", http.StatusConflict, code)
+	}
+	code, _ = registerTopic(t, "testtopic", `{"key":"hunter22","owner_key":"hunter22-owner"}`, "")
+	if code != http.StatusCreated {
+		t.Fatalf("expected topic to be registered got status %d", code)
+	}
+	code, _ = createWebhook(t, "testtopic", `{"url":"http://example.com/hook"}`, "")
+	if code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d got %d", http.StatusUnauthorized, code)
+	}
+
+	for _, body := range []string{`{"url":"ftp://example.com"}`, `{"url":"/relative"}`, `{"url":1}`, `[]`, `{"url":"http://127.0.0.1:8080/hook"}`} {
+		code, _ := createWebhook(t, "testtopic", body, "hunter22-owner")
+		if code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s got %d", http.StatusBadRequest, body, code)
+		}
+	}
+
+	// A secret is generated when none is given
+	code, hook := createWebhook(t, "testtopic", `{"url":"http://example.com/hook"}`, "hunter22-owner")
+	if code != http.StatusCreated || len(hook.Secret) != 64 {
+		t.Fatalf("expected webhook with generated secret got status %d", code)
+	}
+
+	// Secrets are never listed
+	req := httptest.NewRequest(http.MethodGet, "/topics/testtopic/webhooks?key=hunter22-owner", nil)
+	w := httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	hooks := []*Webhook{}
+	err = json.NewDecoder(w.Body).Decode(&hooks)
+	if err != nil {
+		t.Fatalf("decoding response failed: %v", err)
+	}
+	if len(hooks) != 1 || hooks[0].ID != hook.ID || hooks[0].Secret != "" {
+		t.Fatalf("expected webhook %d without secret got %+v", hook.ID, hooks)
+	}
+
+	// Webhooks can only be deleted through their own topic
+	code, _ = registerTopic(t, "othertopic", `{"key":"hunter23","owner_key":"hunter23-owner"}`, "")
+	if code != http.StatusCreated {
+		t.Fatalf("expected topic to be registered got status %d", code)
+	}
+	path := "/topics/othertopic/webhooks/" + strconv.FormatInt(hook.ID, 10) + "?key=hunter23-owner"
+	req = httptest.NewRequest(http.MethodDelete, path, nil)
+	w = httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d got %d", http.StatusNotFound, w.Code)
+	}
+
+	path = "/topics/testtopic/webhooks/" + strconv.FormatInt(hook.ID, 10) + "?key=hunter22-owner"
+	req = httptest.NewRequest(http.MethodDelete, path, nil)
+	w = httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d got %d", http.StatusNoContent, w.Code)
+	}
+	hooks, err = topicWebhooks("testtopic")
+	if err != nil || len(hooks) != 0 {
+		t.Fatalf("expected no webhooks left got %d", len(hooks))
+	}
+
+	// Unregistering a topic removes its webhooks so they aren't passed on to whoever registers it next
+	createWebhook(t, "testtopic", `{"url":"http://example.com/hook"}`, "hunter22-owner")
+	req = httptest.NewRequest(http.MethodDelete, "/topics/testtopic/register?key=hunter22-owner", nil)
+	w = httptest.NewRecorder()
+	setupRouter(testServer()).ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d got %d", http.StatusNoContent, w.Code)
+	}
+	hooks, err = topicWebhooks("testtopic")
+	if err != nil || len(hooks) != 0 {
+		t.Fatalf("expected no webhooks left got %d", len(hooks))
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}
+
+// TestWebhookAddresses checks that webhooks can't be used to reach the network the server runs in
+func TestWebhookAddresses(t *testing.T) {
+	expected := map[string]bool{
+		"http://example.com/hook":                 true,
+		"https://93.184.216.34/hook":              true,
+		"http://[2606:2800:220:1::]/hook":         true,
+		"http://localhost:8080/hook":              false,
+		"http://api.localhost./hook":              false,
+		"http://127.0.0.1/hook":                   false,
+		"http://[::1]/hook":                       false,
+		"http://169.254.169.254/latest/meta-data": false,
+		"http://10.0.0.1/hook":                    false,
+		"http://192.168.1.10:8123/hook":           false,
+		"http://[fd00::1]/hook":                   false,
+		"http://0.0.0.0/hook":                     false,
+		"http://[::ffff:127.0.0.1]/hook":          false,
+	}
+	for url, valid := range expected {
+		if got := validWebhookURL(url); got != valid {
+			t.Errorf("expected %s to be valid: %t got %t", url, valid, got)
+		}
+	}
+
+	// Names are checked once they are resolved, so they can't point somewhere else after being validated
+	reached := int32(0)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(&reached, 1)
+	}))
+	defer receiver.Close()
+	_, err := postSigned(receiver.URL, "", "yoink", "1-1", []byte(`{}`))
+	if err == nil || !strings.Contains(err.Error(), "can't be delivered to 127.0.0.1") || atomic.LoadInt32(&reached) != 0 {
+		t.Fatalf("expected delivering to a loopback address to fail got %v", err)
+	}
+
+	allowPrivateWebhooks = true
+	defer func() { allowPrivateWebhooks = false }()
+	if !validWebhookURL("http://192.168.1.10:8123/hook") {
+		t.Fatalf("expected private addresses to be allowed")
+	}
+	_, err = postSigned(receiver.URL, "", "yoink", "1-1", []byte(`{}`))
+	if err != nil || atomic.LoadInt32(&reached) != 1 {
+		t.Fatalf("expected delivering to a loopback address to be allowed got %v", err)
+	}
+}
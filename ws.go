@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsWriteWait is how long writing a single message to a WebSocket can take
+	wsWriteWait = 10 * time.Second
+
+	// wsPongWait is how long a WebSocket can go without a pong before it's considered dead
+	wsPongWait = 60 * time.Second
+
+	// wsPingPeriod is how often WebSockets are pinged, it has to be shorter than wsPongWait
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// upgrader turns HTTP connections into WebSockets
+var upgrader = websocket.Upgrader{
+	// Publishing and reading are open to everyone and nothing relies on cookies,
+	// so pages on other origins are allowed to connect like any device can
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// wsRequest is a message sent by a WebSocket client
+type wsRequest struct {
+	Action    string          `json:"action"`    // subscribe, unsubscribe or publish
+	Ref       string          `json:"ref"`       // optional, echoed back in the reply so it can be matched to the request
+	Topics    []string        `json:"topics"`    // topics to subscribe to or unsubscribe from
+	Topic     string          `json:"topic"`     // topic to publish to
+	Timestamp json.RawMessage `json:"timestamp"` // optional timestamp of the published yoink
+	Content   json.RawMessage `json:"content"`   // content of the published yoink
+	Key       string          `json:"key"`       // optional key of a registered topic, overrides the one sent when connecting
+}
+
+// wsResponse is a message sent to a WebSocket client
+type wsResponse struct {
+	Type   string     `json:"type"` // subscribed, unsubscribed, published, yoink or error
+	Ref    string     `json:"ref,omitempty"`
+	Topics []string   `json:"topics,omitempty"`
+	Yoink  *Yoink     `json:"yoink,omitempty"`
+	Error  *HTTPError `json:"error,omitempty"`
+}
+
+// wsConn serializes writes to a WebSocket since only one writer is allowed at a time
+type wsConn struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+// send writes a message to the WebSocket
+func (c *wsConn) send(msg wsResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteJSON(msg)
+}
+
+// ping checks that the other side of the WebSocket is still there
+func (c *wsConn) ping() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+}
+
+// ConnectWebSocket lets a client publish yoinks and subscribe to topics over a single WebSocket
+// Clients send JSON messages with an action of subscribe, unsubscribe or publish and get
+// replies of the matching type, or error, along with yoink messages for the topics they subscribed to
+func (s *server) ConnectWebSocket(w http.ResponseWriter, r *http.Request) {
+	// The key and token sent when connecting are used for every message, a message can have its own key
+	connCreds := requestCredentials(r)
+
+	// The upgrader replies with an error itself
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	c := &wsConn{conn: conn}
+
+	// The connection has been taken over from the http server so its deadlines are managed here
+	conn.SetReadLimit(maxBodySize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	sub := yoinkHub.subscribe()
+	defer yoinkHub.unsubscribe(sub)
+
+	// Push yoinks of subscribed topics and keep the connection alive until reading stops
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(wsPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case y := <-sub.yoinks:
+				if c.send(wsResponse{Type: "yoink", Yoink: y}) != nil {
+					conn.Close()
+					return
+				}
+			case <-ticker.C:
+				if c.ping() != nil {
+					conn.Close()
+					return
+				}
+			case <-sub.dropped:
+				// The client fell behind and would silently miss yoinks, so let it know and reconnect
+				c.mu.Lock()
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "subscriber fell behind"), time.Now().Add(wsWriteWait))
+				c.mu.Unlock()
+				conn.Close()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		req := wsRequest{}
+		err := conn.ReadJSON(&req)
+		if err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				e := &HTTPError{Cause: err.Error(), Detail: "Error decoding message", Status: http.StatusBadRequest}
+				if c.send(wsResponse{Type: "error", Error: e}) != nil {
+					return
+				}
+				continue
+			}
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println("reading from websocket failed:", err)
+			}
+			return
+		}
+
+		creds := connCreds
+		if req.Key != "" {
+			creds.key = req.Key
+		}
+		res := s.handleWSRequest(sub, req, creds)
+		res.Ref = req.Ref
+		if c.send(res) != nil {
+			return
+		}
+	}
+}
+
+// handleWSRequest carries out what a WebSocket client asked for and returns the reply
+func (s *server) handleWSRequest(sub *subscription, req wsRequest, creds credentials) wsResponse {
+	switch req.Action {
+	case "subscribe", "unsubscribe":
+		if len(req.Topics) == 0 {
+			return wsError(NewHTTPError("topics is empty", http.StatusBadRequest, "Error validating topics"))
+		}
+		for _, topic := range req.Topics {
+			if topic == "" {
+				return wsError(NewHTTPError("topic is empty", http.StatusBadRequest, "Error validating topic name"))
+			}
+			if req.Action == "subscribe" {
+				err := authorizeRead(topic, creds)
+				if err != nil {
+					return wsError(err)
+				}
+			}
+		}
+		if req.Action == "subscribe" {
+			yoinkHub.addTopics(sub, req.Topics...)
+			return wsResponse{Type: "subscribed", Topics: req.Topics}
+		}
+		yoinkHub.removeTopics(sub, req.Topics...)
+		return wsResponse{Type: "unsubscribed", Topics: req.Topics}
+	case "publish":
+		y, err := s.publishFromWS(req, creds)
+		if err != nil {
+			return wsError(err)
+		}
+		return wsResponse{Type: "published", Yoink: y}
+	}
+	return wsError(NewHTTPError("unknown action "+req.Action, http.StatusBadRequest, "Error validating action"))
+}
+
+// publishFromWS validates and stores a yoink published over a WebSocket the same way PublishForTopic does
+// The content is used like a POST body, so a top-level _timestamp field works too
+func (s *server) publishFromWS(req wsRequest, creds credentials) (*Yoink, error) {
+	if req.Topic == "" {
+		return nil, NewHTTPError("topic is empty", http.StatusBadRequest, "Error validating topic name")
+	}
+
+	err := authorizeTopic(req.Topic, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := compactJSONObject(req.Content)
+	if err != nil {
+		return nil, NewHTTPError(err.Error(), http.StatusBadRequest, "Error validating content")
+	}
+	content, bodyTimestamp, err := extractBodyTimestamp(content)
+	if err != nil {
+		return nil, NewHTTPError(err.Error(), http.StatusBadRequest, "Error reading timestamp from content")
+	}
+
+	// The timestamp of the message takes precedence over the one in the content
+	if len(req.Timestamp) > 0 && string(req.Timestamp) != "null" {
+		bodyTimestamp = req.Timestamp
+	}
+	timestamp := time.Time{}
+	if len(bodyTimestamp) > 0 {
+		timestamp, err = parseTimestampJSON(bodyTimestamp)
+		if err != nil {
+			return nil, NewHTTPError(err.Error(), http.StatusBadRequest, "Error validating timestamp")
+		}
+	}
+
+	yoinks, err := s.storeYoinks(context.Background(), pendingYoink{topic: req.Topic, timestamp: timestamp, content: content})
+	if err != nil {
+		return nil, NewHTTPError(err.Error(), http.StatusInternalServerError, "Error inserting data to database")
+	}
+	return yoinks[0], nil
+}
+
+// wsError turns an error into a reply for a WebSocket client
+func wsError(err error) wsResponse {
+	return wsResponse{Type: "error", Error: asHTTPError(err)}
+}
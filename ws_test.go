@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialWebSocket connects to the WebSocket endpoint of a test server
+func dialWebSocket(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dialing websocket failed: %v", err)
+	}
+	return conn
+}
+
+// readWS reads the next message from a WebSocket
+func readWS(t *testing.T, conn *websocket.Conn) wsResponse {
+	res := wsResponse{}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err := conn.ReadJSON(&res)
+	if err != nil {
+		t.Fatalf("reading from websocket failed: %v", err)
+	}
+	return res
+}
+
+func TestConnectWebSocket(t *testing.T) {
+	initialPath, testPath, err := buildUp()
+	if err != nil {
+		t.Fatalf("buildup failed: %v", err)
+	}
+	srv := httptest.NewServer(setupRouter(testServer()))
+	defer srv.Close()
+
+	conn := dialWebSocket(t, srv)
+	defer conn.Close()
+
+	err = conn.WriteJSON(wsRequest{Action: "subscribe", Ref: "1", Topics: []string{"testtopic", "othertopic"}})
+	if err != nil {
+		t.Fatalf("writing to websocket failed: %v", err)
+	}
+	res := readWS(t, conn)
+	if res.Type != "subscribed" || res.Ref != "1" || len(res.Topics) != 2 {
+		t.Fatalf("unexpected reply to subscribe: %#v", res)
+	}
+
+	// Publishing to a subscribed topic gets both the reply and the yoink, in any order
+	err = conn.WriteJSON(map[string]interface{}{
+		"action":  "publish",
+		"ref":     "2",
+		"topic":   "testtopic",
+		"content": map[string]interface{}{"gps": map[string]interface{}{"lat": 1.2}, "_timestamp": 1666783271},
+	})
+	if err != nil {
+		t.Fatalf("writing to websocket failed: %v", err)
+	}
+	types := map[string]*Yoink{}
+	for i := 0; i < 2; i++ {
+		res = readWS(t, conn)
+		types[res.Type] = res.Yoink
+	}
+	published, yoink := types["published"], types["yoink"]
+	if published == nil || yoink == nil || published.ID != yoink.ID {
+		t.Fatalf("expected published reply and yoink got %#v", types)
+	}
+	if _, ok := published.Content["gps"].(map[string]interface{}); !ok || published.Timestamp.Unix() != 1666783271 {
+		t.Fatalf("yoink not stored correctly: %#v", published)
+	}
+
+	// Yoinks published over HTTP are pushed too
+	_, err = publishYoink("othertopic", "n=1")
+	if err != nil {
+		t.Fatalf("publish yoink failed: %v", err)
+	}
+	res = readWS(t, conn)
+	if res.Type != "yoink" || res.Yoink.Topic != "othertopic" {
+		t.Fatalf("expected yoink of othertopic got %#v", res)
+	}
+
+	// Invalid requests get errors without closing the connection
+	for _, req := range []string{
+		`{"action": "dance"}`,
+		`{"action": "publish", "topic": "testtopic", "content": [1, 2]}`,
+		`{"action": "publish", "content": {"a": 1}}`,
+		`{"action": "publish", "topic": "testtopic", "content": {"a": 1}, "timestamp": "yesterday"}`,
+		`{"action": "subscribe"}`,
+		`not json`,
+	} {
+		err = conn.WriteMessage(websocket.TextMessage, []byte(req))
+		if err != nil {
+			t.Fatalf("writing to websocket failed: %v", err)
+		}
+		res = readWS(t, conn)
+		if res.Type != "error" || res.Error == nil || res.Error.Status != 400 {
+			t.Fatalf("expected error for %s got %#v", req, res)
+		}
+	}
+
+	// Unsubscribed topics are no longer pushed
+	err = conn.WriteJSON(wsRequest{Action: "unsubscribe", Topics: []string{"othertopic"}})
+	if err != nil {
+		t.Fatalf("writing to websocket failed: %v", err)
+	}
+	if res = readWS(t, conn); res.Type != "unsubscribed" {
+		t.Fatalf("unexpected reply to unsubscribe: %#v", res)
+	}
+	_, err = publishYoink("othertopic", "n=2")
+	if err != nil {
+		t.Fatalf("publish yoink failed: %v", err)
+	}
+	_, err = publishYoink("testtopic", "n=3")
+	if err != nil {
+		t.Fatalf("publish yoink failed: %v", err)
+	}
+	res = readWS(t, conn)
+	if res.Type != "yoink" || res.Yoink.Topic != "testtopic" {
+		t.Fatalf("expected yoink of testtopic got %#v", res)
+	}
+
+	err = tearDown(initialPath, testPath)
+	if err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+}